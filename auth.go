@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/armon/go-socks5"
+	"github.com/bmbernie/socks/proxy"
+)
+
+// authMethods maps the names accepted by --auth-methods to the SOCKS5
+// authentication methods they stand for.
+var authMethods = map[string]uint8{
+	"none":     socks5.NoAuthAuthenticator{}.GetCode(),
+	"password": socks5.UserPassAuthenticator{}.GetCode(),
+	"gssapi":   proxy.GSSAPIAuthenticator{}.GetCode(),
+}
+
+// parseAuthMethods parses a comma-separated list of authentication method
+// names, in order of preference.
+func parseAuthMethods(value string) ([]string, error) {
+	var names []string
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if _, ok := authMethods[name]; !ok {
+			return nil, fmt.Errorf("unknown authentication method %q, expected none, password or gssapi", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("authentication method %s is listed twice", name)
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// allowsAnonymous returns whether clients can use the proxy without
+// authenticating, with the given authentication methods.
+func allowsAnonymous(methods []socks5.Authenticator) bool {
+	for _, a := range methods {
+		if a.GetCode() == authMethods["none"] {
+			return true
+		}
+	}
+	return len(methods) == 0
+}
+
+// orderAuthMethods returns the configured authenticators for the named
+// methods, in the order they are named.  Offering no authentication is
+// always possible; the other methods must be configured.
+func orderAuthMethods(configured []socks5.Authenticator, names []string) ([]socks5.Authenticator, error) {
+	var methods []socks5.Authenticator
+	for _, name := range names {
+		var method socks5.Authenticator
+		if name == "none" {
+			method = socks5.NoAuthAuthenticator{}
+		}
+		for _, a := range configured {
+			if a.GetCode() == authMethods[name] {
+				method = a
+			}
+		}
+		if method == nil {
+			return nil, fmt.Errorf("authentication method %s isn't configured", name)
+		}
+		methods = append(methods, method)
+	}
+	return methods, nil
+}
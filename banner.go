@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/bmbernie/socks/proxy"
+	flag "github.com/ogier/pflag"
+)
+
+// secretFlags are the flags whose values are never logged.
+var secretFlags = map[string]bool{
+	"auth":               true,
+	"ssh-answer":         true,
+	"ssh-default-answer": true,
+	"ssh-key-passphrase": true,
+	"ssh-otp":            true,
+}
+
+// urlFlags are the flags holding URLs, whose passwords are redacted before
+// they are logged.
+var urlFlags = map[string]bool{
+	"blocklist-url":   true,
+	"otel-endpoint":   true,
+	"remote-listener": true,
+	"upstream-proxy":  true,
+}
+
+// logSettings logs a summary of the effective settings as a single info-level
+// line, and every flag's value at debug level, with secrets redacted.
+func logSettings(conf *proxy.Config, rules *proxy.Rules, addrs []string) {
+	auth := "none"
+	switch {
+	case flagAuthPAM != "":
+		auth = "pam service=" + flagAuthPAM
+	case len(flagAuth) > 0 || flagAuthFile != "":
+		auth = "password"
+		if flagAuthFile != "" {
+			auth += " file=" + flagAuthFile
+		}
+	}
+	if flagAuthGSSAPI != "" {
+		if auth == "none" {
+			auth = "gssapi"
+		} else {
+			auth += ", gssapi"
+		}
+		auth += " keytab=" + flagAuthGSSAPI
+	}
+	upstream := "direct"
+	switch {
+	case conf.Upstream != nil:
+		upstream = conf.Upstream.String()
+	case flagRemoteEgress:
+		upstream = "remote host"
+	}
+	resolver := "system"
+	switch {
+	case flagNoResolve:
+		resolver = "none"
+	case flagRemoteEgress && flagResolver != "":
+		resolver = flagResolver + " from remote host"
+	case flagRemoteEgress:
+		resolver = "remote host"
+	case flagResolver != "":
+		resolver = flagResolver
+	}
+	ssh := "off"
+	if flagRemoteListener != "" {
+		ssh = fmt.Sprintf("url=%s key=%s jumps=%d keepalive=%s egress=%t reconnect=%t insecure=%t",
+			proxy.RedactURL(flagRemoteListener), orNone(flagSSHKey), len(flagSSHJumps),
+			flagSSHKeepalive, flagRemoteEgress, flagSSHReconnect, flagSSHInsecure)
+	}
+
+	log.Printf("info: effective settings listen=%q auth=%q rules=%q deny_mode=%q dry_run=%t upstream=%q resolver=%q tls=%t "+
+		"dial_timeout=%q dial_retries=%d handshake_timeout=%q idle_timeout=%q max_connection_age=%q shutdown_timeout=%q "+
+		"max_connections=%d rate_limit=%q ssh=%q",
+		strings.Join(addrs, ","), auth, rules.Summary(), flagDenyMode, flagDryRun, upstream, resolver, conf.TLSConfig != nil,
+		flagDialTimeout, flagDialRetries, flagHandshakeTimeout, flagIdleTimeout, flagMaxConnectionAge, flagShutdownTimeout,
+		flagMaxConnections, flagRateLimit.String(), ssh)
+
+	var all []string
+	flag.VisitAll(func(f *flag.Flag) {
+		all = append(all, fmt.Sprintf("%s=%q", f.Name, flagValue(f)))
+	})
+	log.Printf("debug: effective flags %s", strings.Join(all, " "))
+}
+
+// flagValue returns a flag's value as it may be logged.
+func flagValue(f *flag.Flag) string {
+	if secretFlags[f.Name] {
+		if f.Value.String() == "" || f.Value.String() == "[]" {
+			return ""
+		}
+		return "****"
+	}
+	if urlFlags[f.Name] {
+		if s, ok := f.Value.(*proxy.StringSlice); ok {
+			urls := make([]string, len(*s))
+			for i, u := range *s {
+				urls[i] = proxy.RedactURL(u)
+			}
+			return strings.Join(urls, ",")
+		}
+		return proxy.RedactURL(f.Value.String())
+	}
+	return f.Value.String()
+}
+
+// orNone returns s, or "none" if it is empty.
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+
+	flag "github.com/ogier/pflag"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Config is the contents of a configuration file given with --config.  Each
+// key corresponds to the command-line flag of the same name, with
+// underscores in place of dashes.  Flags given on the command line take
+// precedence over values from the file.
+type Config struct {
+	Host           string     `yaml:"host"`
+	Port           uint16     `yaml:"port"`
+	SourceIPs      stringList `yaml:"source_ips"`
+	DestIPs        stringList `yaml:"dest_ips"`
+	DestPorts      stringList `yaml:"dest_ports"`
+	DenySourceIPs  stringList `yaml:"deny_source_ips"`
+	DenyDestIPs    stringList `yaml:"deny_dest_ips"`
+	Rule           stringList `yaml:"rule"`
+	RulesFile      string     `yaml:"rules_file"`
+	Auth           stringList `yaml:"auth"`
+	AuthFile       string     `yaml:"auth_file"`
+	AuthPAM        string     `yaml:"auth_pam"`
+	AuthGSSAPI     string     `yaml:"auth_gssapi"`
+	AuthMethods    string     `yaml:"auth_methods"`
+	RemoteListener string     `yaml:"remote_listener"`
+	LogLevel       string     `yaml:"log_level"`
+
+	// keys records which keys were present in the file.
+	keys map[string]bool
+}
+
+// stringList is a list setting, which may also be given as a single value.
+type stringList []string
+
+func (l *stringList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var values []string
+	if err := unmarshal(&values); err == nil {
+		*l = values
+		return nil
+	}
+
+	var value string
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	if value != "" {
+		*l = stringList{value}
+	}
+	return nil
+}
+
+// LoadConfig reads a configuration file.
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Config{}
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	// Flags are only set from the keys that are present, even those with
+	// an empty value
+	var keys map[string]interface{}
+	if err := yaml.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	c.keys = make(map[string]bool)
+	for key := range keys {
+		c.keys[key] = true
+	}
+	return c, nil
+}
+
+// Apply sets every flag that was not given on the command line to the
+// corresponding value from the configuration file.
+func (c *Config) Apply(fs *flag.FlagSet) error {
+	changed := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		changed[f.Name] = true
+	})
+
+	for key, field := range configFields(c) {
+		name := strings.Replace(key, "_", "-", -1)
+		if !c.keys[key] || changed[name] {
+			continue
+		}
+
+		var values []string
+		if list, ok := field.Interface().(stringList); ok {
+			values = list
+		} else {
+			values = []string{fmt.Sprint(field.Interface())}
+		}
+
+		for _, v := range values {
+			if err := fs.Set(name, v); err != nil {
+				return fmt.Errorf("%s: %s", key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// configFields returns the settable fields of a Config, keyed by their YAML
+// name.
+func configFields(c *Config) map[string]reflect.Value {
+	fields := make(map[string]reflect.Value)
+
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if key := t.Field(i).Tag.Get("yaml"); key != "" {
+			fields[key] = v.Field(i)
+		}
+	}
+	return fields
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bmbernie/socks/proxy"
+	flag "github.com/ogier/pflag"
+)
+
+// writeConfig writes a configuration file and returns its path.
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "socks.yml")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	c, err := LoadConfig(writeConfig(t, `---
+host: 192.168.0.1   # comment
+port: 8000
+source_ips: 10.0.0.0/8
+dest_ips:
+  - 10.0.0.0/8
+  - "192.168.0.0/16"
+dest_ports: [22, 443]
+auth_file:
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Host != "192.168.0.1" || c.Port != 8000 {
+		t.Errorf("got host %q and port %d", c.Host, c.Port)
+	}
+	if want := (stringList{"10.0.0.0/8"}); !reflect.DeepEqual(c.SourceIPs, want) {
+		t.Errorf("got source_ips %q, want %q", c.SourceIPs, want)
+	}
+	if want := (stringList{"10.0.0.0/8", "192.168.0.0/16"}); !reflect.DeepEqual(c.DestIPs, want) {
+		t.Errorf("got dest_ips %q, want %q", c.DestIPs, want)
+	}
+	if want := (stringList{"22", "443"}); !reflect.DeepEqual(c.DestPorts, want) {
+		t.Errorf("got dest_ports %q, want %q", c.DestPorts, want)
+	}
+	for _, key := range []string{"host", "port", "source_ips", "dest_ips", "dest_ports", "auth_file"} {
+		if !c.keys[key] {
+			t.Errorf("key %s not recorded", key)
+		}
+	}
+	if c.keys["auth"] {
+		t.Error("absent key auth recorded")
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		content string
+		err     string
+	}{
+		{"host: localhost\nsource_ip: 10.0.0.0/8\n", "field source_ip not found"},
+		{"port: 8000\nport: 8001\n", "field port already set"},
+		{"port: http\n", "cannot unmarshal"},
+		{"port: 65536\n", "cannot unmarshal"},
+		{"host: [a, b]\n", "cannot unmarshal"},
+		{"dest_ips:\n  nested: 10.0.0.0/8\n", "cannot unmarshal"},
+	}
+
+	for _, tt := range tests {
+		path := writeConfig(t, tt.content)
+		_, err := LoadConfig(path)
+		if err == nil {
+			t.Errorf("%q: loaded without error", tt.content)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), path+": ") || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%q: got error %q, want one naming the file and containing %q", tt.content, err, tt.err)
+		}
+	}
+}
+
+func TestConfigApply(t *testing.T) {
+	c, err := LoadConfig(writeConfig(t, `
+host: 192.168.0.1
+port: 8000
+dest_ips: [10.0.0.0/8, 192.168.0.0/16]
+source_ips: [10.0.0.0/8]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := flag.NewFlagSet("socks", flag.ContinueOnError)
+	host := fs.String("host", "localhost", "")
+	port := fs.Uint16("port", 1080, "")
+	var dest, source proxy.StringSlice
+	fs.Var(&dest, "dest-ips", "")
+	fs.Var(&source, "source-ips", "")
+	logLevel := fs.String("log-level", "info", "")
+	if err := fs.Parse([]string{"--port=9000", "--source-ips=172.16.0.0/12"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Apply(fs); err != nil {
+		t.Fatal(err)
+	}
+	if *host != "192.168.0.1" {
+		t.Errorf("host is %q, want the file's", *host)
+	}
+	if *port != 9000 {
+		t.Errorf("port is %d, want the command line's", *port)
+	}
+	if want := (proxy.StringSlice{"10.0.0.0/8", "192.168.0.0/16"}); !reflect.DeepEqual(dest, want) {
+		t.Errorf("dest-ips is %q, want %q", dest, want)
+	}
+	if want := (proxy.StringSlice{"172.16.0.0/12"}); !reflect.DeepEqual(source, want) {
+		t.Errorf("source-ips is %q, want the command line's %q", source, want)
+	}
+	if *logLevel != "info" {
+		t.Errorf("log-level is %q, want the default", *logLevel)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	flag "github.com/ogier/pflag"
+)
+
+// envPrefix is prepended to a flag's name, upper-cased and with underscores
+// in place of dashes, to give the environment variable it can be set from.
+const envPrefix = "SOCKS_"
+
+// envName returns the environment variable for the named flag.
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// envListFlags are the repeatable flags whose environment variable holds a
+// comma-separated list.  Other flags, such as --auth and --allow-hours, may
+// have commas in their values, so their variable holds a single value.
+var envListFlags = map[string]bool{
+	"listen":          true,
+	"source-ips":      true,
+	"dest-ips":        true,
+	"deny-source-ips": true,
+	"deny-dest-ips":   true,
+	"dest-ports":      true,
+	"allow-domain":    true,
+	"deny-domain":     true,
+	"allow-country":   true,
+	"deny-country":    true,
+	"ssh-jump":        true,
+}
+
+// applyEnv sets every flag that was not given on the command line from its
+// environment variable, if that is set.
+func applyEnv(fs *flag.FlagSet) error {
+	changed := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		changed[f.Name] = true
+	})
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if err != nil || !ok || changed[f.Name] {
+			return
+		}
+
+		values := []string{value}
+		if envListFlags[f.Name] {
+			values = strings.Split(value, ",")
+		}
+		for _, v := range values {
+			if envListFlags[f.Name] {
+				v = strings.TrimSpace(v)
+			}
+			if e := fs.Set(f.Name, v); e != nil {
+				err = fmt.Errorf("%s: %s", envName(f.Name), e)
+				return
+			}
+		}
+	})
+	return err
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/bmbernie/socks/proxy"
+	flag "github.com/ogier/pflag"
+)
+
+func TestApplyEnv(t *testing.T) {
+	fs := flag.NewFlagSet("socks", flag.ContinueOnError)
+	port := fs.Uint16("port", 1080, "")
+	var auth, source, dest proxy.StringSlice
+	fs.Var(&auth, "auth", "")
+	fs.Var(&source, "source-ips", "")
+	fs.Var(&dest, "dest-ips", "")
+	var hours proxy.TimeWindowSlice
+	fs.Var(&hours, "allow-hours", "")
+	if err := fs.Parse([]string{"--dest-ips=10.0.0.0/8"}); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("SOCKS_PORT", "9000")
+	t.Setenv("SOCKS_AUTH", "user:pa,ss")
+	t.Setenv("SOCKS_SOURCE_IPS", "10.0.0.0/8, 192.168.0.0/16")
+	t.Setenv("SOCKS_DEST_IPS", "172.16.0.0/12")
+	t.Setenv("SOCKS_ALLOW_HOURS", "Mon,Wed 09:00-17:00")
+	if err := applyEnv(fs); err != nil {
+		t.Fatal(err)
+	}
+
+	if *port != 9000 {
+		t.Errorf("port is %d, want 9000", *port)
+	}
+	if want := (proxy.StringSlice{"user:pa,ss"}); !reflect.DeepEqual(auth, want) {
+		t.Errorf("auth is %q, want %q", auth, want)
+	}
+	if want := (proxy.StringSlice{"10.0.0.0/8", "192.168.0.0/16"}); !reflect.DeepEqual(source, want) {
+		t.Errorf("source-ips is %q, want %q", source, want)
+	}
+	if want := (proxy.StringSlice{"10.0.0.0/8"}); !reflect.DeepEqual(dest, want) {
+		t.Errorf("dest-ips is %q, want the command line's %q", dest, want)
+	}
+	if len(hours) != 1 {
+		t.Errorf("allow-hours has %d windows, want 1", len(hours))
+	}
+}
+
+func TestEnvListFlags(t *testing.T) {
+	for name := range envListFlags {
+		if flag.Lookup(name) == nil {
+			t.Errorf("%s is not a flag", name)
+		}
+	}
+}
@@ -1,16 +0,0 @@
-package main
-
-import (
-	"fmt"
-)
-
-type StringSlice []string
-
-func (s *StringSlice) String() string {
-	return fmt.Sprintf("%+v", *s)
-}
-
-func (s *StringSlice) Set(value string) error {
-	*s = append(*s, value)
-	return nil
-}
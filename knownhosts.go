@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// knownHost is a single entry from a known_hosts file.
+type knownHost struct {
+	patterns []string
+	key      ssh.PublicKey
+	revoked  bool
+}
+
+// KnownHosts verifies SSH host keys against the entries of an OpenSSH
+// known_hosts file.
+type KnownHosts struct {
+	path  string
+	hosts []knownHost
+}
+
+// defaultKnownHostsPath returns the path of the current user's known_hosts
+// file.
+func defaultKnownHostsPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".ssh", "known_hosts"), nil
+}
+
+// LoadKnownHosts reads a known_hosts file.  Certificate authority entries
+// are not supported and are skipped.
+func LoadKnownHosts(file string) (*KnownHosts, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	kh := &KnownHosts{path: file}
+
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		var entry knownHost
+		if strings.HasPrefix(fields[0], "@") {
+			switch fields[0] {
+			case "@revoked":
+				entry.revoked = true
+			case "@cert-authority":
+				continue
+			default:
+				return nil, fmt.Errorf("%s:%d: unknown marker %s", file, lineno, fields[0])
+			}
+			fields = fields[1:]
+		}
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("%s:%d: expected 'hosts keytype key'", file, lineno)
+		}
+
+		keyBytes, err := base64.StdEncoding.DecodeString(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid key: %s", file, lineno, err)
+		}
+		if entry.key, err = ssh.ParsePublicKey(keyBytes); err != nil {
+			// Key types we don't understand can't match anyway
+			continue
+		}
+
+		entry.patterns = strings.Split(fields[0], ",")
+		kh.hosts = append(kh.hosts, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return kh, nil
+}
+
+// HostKeyCallback checks that the key presented by the host is listed for it
+// in the known_hosts file.  It can be used as ssh.ClientConfig.HostKeyCallback.
+func (kh *KnownHosts) HostKeyCallback(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	names := []string{knownHostsName(hostname)}
+	if tcp, ok := remote.(*net.TCPAddr); ok {
+		names = append(names, knownHostsName(net.JoinHostPort(tcp.IP.String(), fmt.Sprint(tcp.Port))))
+	}
+
+	var found, matched bool
+	for _, entry := range kh.hosts {
+		if !entry.matches(names) {
+			continue
+		}
+
+		sameKey := bytes.Equal(entry.key.Marshal(), key.Marshal())
+		if entry.revoked && sameKey {
+			return fmt.Errorf("host key for %s has been revoked", hostname)
+		}
+		if !entry.revoked && entry.key.Type() == key.Type() {
+			found = true
+			matched = matched || sameKey
+		}
+	}
+
+	switch {
+	case matched:
+		return nil
+	case found:
+		return fmt.Errorf("host key mismatch for %s: the key does not match the one in %s, "+
+			"which may mean someone is intercepting the connection", hostname, kh.path)
+	default:
+		return fmt.Errorf("unknown host %s: no %s key found in %s", hostname, key.Type(), kh.path)
+	}
+}
+
+// matches returns whether any of the given names matches the entry's host
+// patterns, and none matches a negated pattern.
+func (e knownHost) matches(names []string) bool {
+	var matched bool
+	for _, pattern := range e.patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+
+		for _, name := range names {
+			if !matchKnownHost(pattern, name) {
+				continue
+			}
+			if negated {
+				return false
+			}
+			matched = true
+		}
+	}
+	return matched
+}
+
+func matchKnownHost(pattern, name string) bool {
+	// Hashed entries are of the form |1|base64(salt)|base64(hmac-sha1(salt, name))
+	if strings.HasPrefix(pattern, "|1|") {
+		parts := strings.Split(pattern[3:], "|")
+		if len(parts) != 2 {
+			return false
+		}
+		salt, err := base64.StdEncoding.DecodeString(parts[0])
+		if err != nil {
+			return false
+		}
+		hash, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return false
+		}
+
+		mac := hmac.New(sha1.New, salt)
+		mac.Write([]byte(name))
+		return hmac.Equal(mac.Sum(nil), hash)
+	}
+
+	return wildcardMatch(pattern, name)
+}
+
+// wildcardMatch matches a name against a pattern where '*' matches any
+// sequence of characters and '?' matches any single character.
+func wildcardMatch(pattern, name string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(name); i >= 0; i-- {
+				if wildcardMatch(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(name) == 0 {
+				return false
+			}
+		default:
+			if len(name) == 0 || pattern[0] != name[0] {
+				return false
+			}
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// knownHostsName converts a host:port address to the form used in
+// known_hosts files: the bare host for port 22, or [host]:port otherwise.
+func knownHostsName(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if port == "22" {
+		return host
+	}
+	return "[" + host + "]:" + port
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// unixPrefix marks a listen address as the path of a Unix socket.
+const unixPrefix = "unix:"
+
+// unixSocketPath returns the socket path of a "unix:" listen address.
+func unixSocketPath(addr string) (string, bool) {
+	if !strings.HasPrefix(addr, unixPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(addr, unixPrefix), true
+}
+
+// listen listens on a TCP address, or on a Unix socket for a "unix:" address.
+// A Unix socket is given the file mode mode, and a stale socket file left
+// behind by a proxy that didn't shut down cleanly is replaced.
+func listen(addr string, mode os.FileMode) (net.Listener, error) {
+	path, ok := unixSocketPath(addr)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+		} else {
+			os.Remove(path)
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// parseSocketMode parses an octal file mode such as "0660".
+func parseSocketMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, strconv.ErrSyntax
+	}
+	return os.FileMode(mode), nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListenOccupiedPort(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	l2, err := listen(l.Addr().String(), 0600)
+	if err == nil {
+		l2.Close()
+		t.Fatalf("listening on occupied %s succeeded", l.Addr())
+	}
+	if opErr, ok := err.(*net.OpError); !ok || opErr.Op != "listen" {
+		t.Errorf("got error %q, want a listen error", err)
+	}
+}
+
+// TestBindFailure runs the proxy on a port that is already in use, in a
+// child process running this test, and checks that it exits with an error
+// rather than a panic.
+func TestBindFailure(t *testing.T) {
+	if addr := os.Getenv("SOCKS_TEST_BIND_FAILURE"); addr != "" {
+		os.Args = []string{"socks", "--listen=" + addr}
+		main()
+		return
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	addr := l.Addr().String()
+
+	// Don't let the environment set any other flags
+	var env []string
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, "SOCKS_") && !strings.HasPrefix(v, "LISTEN_") && !strings.HasPrefix(v, "NOTIFY_SOCKET=") {
+			env = append(env, v)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, os.Args[0], "-test.run=^TestBindFailure$")
+	cmd.Env = append(env, "SOCKS_TEST_BIND_FAILURE="+addr)
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		t.Fatalf("proxy didn't exit:\n%s", out)
+	}
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 1 {
+		t.Errorf("proxy exited with %v, want exit status 1", err)
+	}
+	if !strings.Contains(string(out), "failed to bind "+addr+": ") {
+		t.Errorf("output doesn't report the bind failure:\n%s", out)
+	}
+	if strings.Contains(string(out), "panic:") {
+		t.Errorf("proxy panicked:\n%s", out)
+	}
+}
+
+func TestListenUnixSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("socket file modes are Unix-only")
+	}
+	path := filepath.Join(t.TempDir(), "socks.sock")
+
+	l, err := listen(unixPrefix+path, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := fi.Mode().Perm(); mode != 0660 {
+		t.Errorf("socket has mode %o, want 660", mode)
+	}
+
+	// A socket that is in use isn't replaced
+	if l2, err := listen(unixPrefix+path, 0660); err == nil {
+		l2.Close()
+		t.Error("listening on a socket in use succeeded")
+	}
+
+	// But a stale one is
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	l, err = listen(unixPrefix+path, 0660)
+	if err != nil {
+		t.Fatalf("stale socket wasn't replaced: %s", err)
+	}
+	l.Close()
+}
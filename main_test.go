@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestListenAddr(t *testing.T) {
+	tests := []struct {
+		host string
+		port uint16
+		want string
+	}{
+		{"127.0.0.1", 8000, "127.0.0.1:8000"},
+		{"0.0.0.0", 1080, "0.0.0.0:1080"},
+		{"::1", 8000, "[::1]:8000"},
+		{"::", 8000, "[::]:8000"},
+		{"fe80::1%eth0", 8000, "[fe80::1%eth0]:8000"},
+		{"", 8000, ":8000"},
+		{"localhost", 8000, "localhost:8000"},
+		{"proxy.example.com", 0, "proxy.example.com:0"},
+		{"unix:/run/socks.sock", 8000, "unix:/run/socks.sock"},
+	}
+
+	for _, tt := range tests {
+		if got := listenAddr(tt.host, tt.port); got != tt.want {
+			t.Errorf("listenAddr(%q, %d) = %q, want %q", tt.host, tt.port, got, tt.want)
+		}
+	}
+}
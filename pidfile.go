@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// writePIDFile writes the current process ID to path.  It refuses to
+// overwrite a PID file belonging to a process that is still running, but
+// replaces a stale one left behind by a crash.
+func writePIDFile(path string) error {
+	if data, err := ioutil.ReadFile(path); err == nil {
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err == nil && processRunning(pid) {
+			return fmt.Errorf("%s belongs to running process %d", path, pid)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	return ioutil.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+// removePIDFile removes the PID file, if it still contains our process ID.
+func removePIDFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(data)) != strconv.Itoa(os.Getpid()) {
+		return fmt.Errorf("%s no longer contains our PID, leaving it alone", path)
+	}
+	return os.Remove(path)
+}
+
+// processRunning returns whether a process with the given ID exists.
+func processRunning(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	// Signal 0 performs the existence check without delivering a signal
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || err == syscall.EPERM
+}
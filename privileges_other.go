@@ -0,0 +1,13 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import (
+	"errors"
+)
+
+// dropPrivileges is not supported on this platform.
+func dropPrivileges(username, groupname string) error {
+	return errors.New("--user and --group are not supported on this platform")
+}
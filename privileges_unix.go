@@ -0,0 +1,63 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges switches the process to the given user and group.  If no
+// group is given, the user's primary group is used.
+func dropPrivileges(username, groupname string) error {
+	uid, gid := -1, -1
+
+	if username != "" {
+		u, err := user.Lookup(username)
+		if err != nil {
+			return err
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return fmt.Errorf("invalid uid %q for user %s", u.Uid, username)
+		}
+		if gid, err = strconv.Atoi(u.Gid); err != nil {
+			return fmt.Errorf("invalid gid %q for user %s", u.Gid, username)
+		}
+	}
+	if groupname != "" {
+		g, err := user.LookupGroup(groupname)
+		if err != nil {
+			return err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return fmt.Errorf("invalid gid %q for group %s", g.Gid, groupname)
+		}
+	}
+
+	// The group has to be changed first, since we can't do it once we are
+	// no longer root.
+	if gid >= 0 {
+		if err := syscall.Setgroups([]int{gid}); err != nil {
+			return fmt.Errorf("setgroups: %s", err)
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			return fmt.Errorf("setgid: %s", err)
+		}
+	}
+	if uid >= 0 {
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("setuid: %s", err)
+		}
+	}
+
+	if gid >= 0 && syscall.Getegid() != gid {
+		return fmt.Errorf("effective gid is %d, not %d", syscall.Getegid(), gid)
+	}
+	if uid >= 0 && syscall.Geteuid() != uid {
+		return fmt.Errorf("effective uid is %d, not %d", syscall.Geteuid(), uid)
+	}
+	return nil
+}
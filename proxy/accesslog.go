@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// writeAccessLog writes the access log line for a closed connection, in a
+// format modelled on the Common Log Format:
+//
+//	src - user [time] "COMMAND dst" result bytes_up bytes_down duration_seconds
+//
+// The command is CONNECT or BIND, and the user is "-" if the client didn't
+// authenticate.
+func writeAccessLog(accessLog io.Writer, c *proxyConn, start time.Time, duration time.Duration) {
+	if accessLog == nil {
+		return
+	}
+
+	command, dest, result := c.destResult()
+	user := c.authUser()
+	if user == "" {
+		user = "-"
+	}
+	_, err := fmt.Fprintf(accessLog, "%s - %s [%s] \"%s %s\" %s %d %d %.3f\n",
+		c.RemoteAddr(), user, start.Format("02/Jan/2006:15:04:05 -0700"), command, dest, result,
+		atomic.LoadUint64(&c.bytesUp), atomic.LoadUint64(&c.bytesDown), duration.Seconds())
+	if err != nil {
+		log.Printf("error: conn=%s could not write access log: %s", c.id, err)
+	}
+}
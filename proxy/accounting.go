@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"encoding/csv"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Accounting totals the bytes relayed for each source IP and authenticated
+// user, e.g. to bill the users of a shared proxy.
+type Accounting struct {
+	mu sync.Mutex
+	m  map[accountKey]*accountBytes
+}
+
+type accountKey struct {
+	source string
+	user   string
+}
+
+type accountBytes struct {
+	up   uint64
+	down uint64
+}
+
+// NewAccounting returns an empty accounting table.
+func NewAccounting() *Accounting {
+	return &Accounting{m: make(map[accountKey]*accountBytes)}
+}
+
+// add counts bytes relayed for a connection.  It does nothing if a is nil.
+func (a *Accounting) add(c *proxyConn, up, down uint64) {
+	if a == nil {
+		return
+	}
+	key := accountKey{source: sourceIP(c.Conn), user: c.authUser()}
+
+	a.mu.Lock()
+	b := a.m[key]
+	if b == nil {
+		b = &accountBytes{}
+		a.m[key] = b
+	}
+	b.up += up
+	b.down += down
+	a.mu.Unlock()
+}
+
+// accountEntry is a row of the accounting table.
+type accountEntry struct {
+	accountKey
+	accountBytes
+}
+
+// entries returns a copy of the table, sorted by source and user.
+func (a *Accounting) entries() []accountEntry {
+	a.mu.Lock()
+	entries := make([]accountEntry, 0, len(a.m))
+	for k, b := range a.m {
+		entries = append(entries, accountEntry{k, *b})
+	}
+	a.mu.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].source != entries[j].source {
+			return entries[i].source < entries[j].source
+		}
+		return entries[i].user < entries[j].user
+	})
+	return entries
+}
+
+// WriteCSV writes the table as CSV, with a header line of
+// "source,user,bytes_up,bytes_down".
+func (a *Accounting) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"source", "user", "bytes_up", "bytes_down"})
+	for _, e := range a.entries() {
+		cw.Write([]string{e.source, e.user,
+			strconv.FormatUint(e.up, 10), strconv.FormatUint(e.down, 10)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteFile replaces the file at path with the table as CSV.  The new
+// contents are written to a temporary file first, so that readers never see
+// a partial table.
+func (a *Accounting) WriteFile(path string) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if err := a.WriteCSV(f); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ACLRule allows or denies connections over a protocol to a set of
+// destination addresses and ports, e.g. "allow tcp 10.0.0.0/8:443".  A nil
+// Dest matches any address, and a nil Ports any port.
+type ACLRule struct {
+	Allow    bool
+	Protocol string // "tcp", "udp" or "any"
+	Dest     *net.IPNet
+	Ports    *PortRange
+
+	text string
+}
+
+func (r ACLRule) String() string {
+	return r.text
+}
+
+// Matches returns whether the rule applies to a connection over the protocol
+// to dstIP:dstPort.
+func (r ACLRule) Matches(protocol string, dstIP net.IP, dstPort int) bool {
+	if r.Protocol != "any" && r.Protocol != protocol {
+		return false
+	}
+	if r.Dest != nil && !r.Dest.Contains(dstIP) {
+		return false
+	}
+	if r.Ports != nil && (dstPort < r.Ports.Low || dstPort > r.Ports.High) {
+		return false
+	}
+	return true
+}
+
+// ACLRuleSlice is a flag that accepts rules like "allow tcp 10.0.0.0/8:443"
+// or "deny any any:*", in the order they are to be checked.
+type ACLRuleSlice []ACLRule
+
+func (s *ACLRuleSlice) String() string {
+	return fmt.Sprintf("%+v", *s)
+}
+
+func (s *ACLRuleSlice) Set(value string) error {
+	r, err := parseACLRule(value)
+	if err != nil {
+		return err
+	}
+	*s = append(*s, r)
+	return nil
+}
+
+// Match returns the first rule that applies to a connection over the
+// protocol to dstIP:dstPort, and false if none does.
+func (s ACLRuleSlice) Match(protocol string, dstIP net.IP, dstPort int) (ACLRule, bool) {
+	for _, r := range s {
+		if r.Matches(protocol, dstIP, dstPort) {
+			return r, true
+		}
+	}
+	return ACLRule{}, false
+}
+
+// parseACLRule parses a rule of the form "<allow|deny> <protocol>
+// <dest>:<ports>", where dest is an IP address, a CIDR range or "any", with
+// IPv6 addresses in brackets, and ports is a port, a range or "*".
+func parseACLRule(value string) (ACLRule, error) {
+	r := ACLRule{text: strings.Join(strings.Fields(value), " ")}
+
+	fields := strings.Fields(value)
+	if len(fields) != 3 {
+		return r, fmt.Errorf("invalid rule %q: expected '<allow|deny> <protocol> <dest>:<ports>'", value)
+	}
+
+	switch fields[0] {
+	case "allow":
+		r.Allow = true
+	case "deny":
+	default:
+		return r, fmt.Errorf("invalid rule %q: action must be allow or deny", value)
+	}
+
+	switch r.Protocol = strings.ToLower(fields[1]); r.Protocol {
+	case "tcp", "udp", "any":
+	default:
+		return r, fmt.Errorf("invalid rule %q: protocol must be tcp, udp or any", value)
+	}
+
+	i := strings.LastIndex(fields[2], ":")
+	if i < 0 {
+		return r, fmt.Errorf("invalid rule %q: destination must be <address>:<ports>", value)
+	}
+	dest, ports := fields[2][:i], fields[2][i+1:]
+
+	if dest = strings.TrimSuffix(strings.TrimPrefix(dest, "["), "]"); dest != "any" {
+		n, err := parseIPNet(dest)
+		if err != nil {
+			return r, fmt.Errorf("invalid rule %q: %s", value, err)
+		}
+		r.Dest = n
+	}
+
+	if ports != "*" {
+		pr, err := parsePortRange(ports)
+		if err != nil {
+			return r, fmt.Errorf("invalid rule %q: %s", value, err)
+		}
+		r.Ports = &pr
+	}
+	return r, nil
+}
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseACLRuleErrors(t *testing.T) {
+	tests := []struct {
+		rule string
+		err  string
+	}{
+		{"", "expected '<allow|deny> <protocol> <dest>:<ports>'"},
+		{"allow tcp", "expected '<allow|deny> <protocol> <dest>:<ports>'"},
+		{"allow tcp 10.0.0.0/8:443 extra", "expected '<allow|deny> <protocol> <dest>:<ports>'"},
+		{"permit tcp 10.0.0.0/8:443", "action must be allow or deny"},
+		{"allow icmp 10.0.0.0/8:443", "protocol must be tcp, udp or any"},
+		{"allow tcp 10.0.0.0/8", "destination must be <address>:<ports>"},
+		{"allow tcp 10.0.0.0/33:443", "invalid CIDR"},
+		{"allow tcp example.com:443", "invalid IP address"},
+		{"allow tcp *:443", "invalid IP address"},
+		{"allow tcp any:https", "invalid port range"},
+		{"allow tcp any:65536", "invalid port range"},
+		{"allow tcp any:443-80", "invalid port range"},
+		{"allow tcp any:", "invalid port range"},
+	}
+
+	for _, tt := range tests {
+		_, err := parseACLRule(tt.rule)
+		if err == nil {
+			t.Errorf("%q: parsed without error", tt.rule)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%q: got error %q, want it to contain %q", tt.rule, err, tt.err)
+		}
+	}
+}
+
+func TestACLRuleMatches(t *testing.T) {
+	tests := []struct {
+		rule     string
+		protocol string
+		ip       string
+		port     int
+		want     bool
+	}{
+		// Wildcards
+		{"allow any any:*", "tcp", "192.0.2.1", 1, true},
+		{"allow any any:*", "udp", "2001:db8::1", 65535, true},
+		{"allow ANY any:*", "udp", "192.0.2.1", 53, true},
+		{"deny tcp any:*", "udp", "192.0.2.1", 53, false},
+		{"deny udp any:*", "udp", "192.0.2.1", 53, true},
+
+		// Destinations
+		{"allow tcp 10.0.0.0/8:*", "tcp", "10.1.2.3", 80, true},
+		{"allow tcp 10.0.0.0/8:*", "tcp", "11.1.2.3", 80, false},
+		{"allow tcp 192.0.2.1:*", "tcp", "192.0.2.1", 80, true},
+		{"allow tcp 192.0.2.1:*", "tcp", "192.0.2.2", 80, false},
+		{"allow tcp [2001:db8::/32]:443", "tcp", "2001:db8::1", 443, true},
+		{"allow tcp [2001:db8::/32]:443", "tcp", "2001:db9::1", 443, false},
+		{"allow tcp [::1]:22", "tcp", "::1", 22, true},
+
+		// Ports
+		{"allow tcp any:443", "tcp", "192.0.2.1", 443, true},
+		{"allow tcp any:443", "tcp", "192.0.2.1", 444, false},
+		{"allow tcp any:8000-8080", "tcp", "192.0.2.1", 8000, true},
+		{"allow tcp any:8000-8080", "tcp", "192.0.2.1", 8080, true},
+		{"allow tcp any:8000-8080", "tcp", "192.0.2.1", 8081, false},
+		{"allow tcp any:8000-8080", "tcp", "192.0.2.1", 7999, false},
+	}
+
+	for _, tt := range tests {
+		r, err := parseACLRule(tt.rule)
+		if err != nil {
+			t.Errorf("%q: %s", tt.rule, err)
+			continue
+		}
+		if got := r.Matches(tt.protocol, net.ParseIP(tt.ip), tt.port); got != tt.want {
+			t.Errorf("%q.Matches(%s, %s, %d) = %v, want %v", tt.rule, tt.protocol, tt.ip, tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestACLRuleSliceMatch(t *testing.T) {
+	var acl ACLRuleSlice
+	for _, rule := range []string{
+		"allow tcp 10.0.0.1:22",
+		"deny  tcp 10.0.0.0/8:22",
+		"allow tcp 10.0.0.0/8:*",
+		"deny  any any:*",
+	} {
+		if err := acl.Set(rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		ip      string
+		port    int
+		matched string
+		allow   bool
+	}{
+		// The first matching rule wins, even when later ones also match
+		{"10.0.0.1", 22, "allow tcp 10.0.0.1:22", true},
+		{"10.0.0.2", 22, "deny tcp 10.0.0.0/8:22", false},
+		{"10.0.0.2", 443, "allow tcp 10.0.0.0/8:*", true},
+		{"192.0.2.1", 443, "deny any any:*", false},
+	}
+	for _, tt := range tests {
+		r, ok := acl.Match("tcp", net.ParseIP(tt.ip), tt.port)
+		if !ok {
+			t.Errorf("%s:%d: no rule matched", tt.ip, tt.port)
+			continue
+		}
+		if r.String() != tt.matched || r.Allow != tt.allow {
+			t.Errorf("%s:%d: matched %q (allow=%v), want %q (allow=%v)", tt.ip, tt.port, r, r.Allow, tt.matched, tt.allow)
+		}
+	}
+
+	if r, ok := acl[:3].Match("tcp", net.ParseIP("192.0.2.1"), 443); ok {
+		t.Errorf("192.0.2.1:443: matched %q, want no match", r)
+	}
+}
@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// connStatus describes an active connection, as listed by the admin API.
+type connStatus struct {
+	Conn      string  `json:"conn"`
+	Source    string  `json:"src"`
+	User      string  `json:"user,omitempty"`
+	Command   string  `json:"command,omitempty"`
+	Dest      string  `json:"dst,omitempty"`
+	BytesUp   uint64  `json:"bytes_up"`
+	BytesDown uint64  `json:"bytes_down"`
+	Duration  float64 `json:"duration"`
+}
+
+// listStatus describes a set of allow- and deny-lists, as shown by the admin
+// API.
+type listStatus struct {
+	Source     []string `json:"source_ips,omitempty"`
+	Dest       []string `json:"dest_ips,omitempty"`
+	Ports      []string `json:"dest_ports,omitempty"`
+	DenySource []string `json:"deny_source_ips,omitempty"`
+	DenyDest   []string `json:"deny_dest_ips,omitempty"`
+}
+
+// rulesStatus describes the rules in effect, including those read from the
+// rules file, as shown by the admin API.
+type rulesStatus struct {
+	listStatus
+	Users          map[string]listStatus `json:"users,omitempty"`
+	ACL            []string              `json:"rules,omitempty"`
+	AllowHours     []string              `json:"allow_hours,omitempty"`
+	AllowCountries []string              `json:"allow_countries,omitempty"`
+	DenyCountries  []string              `json:"deny_countries,omitempty"`
+	DenyPrivate    bool                  `json:"deny_private"`
+	Bind           bool                  `json:"bind"`
+}
+
+func (l *ruleLists) status() listStatus {
+	var s listStatus
+	for _, n := range l.source {
+		s.Source = append(s.Source, n.String())
+	}
+	for _, n := range l.dest {
+		s.Dest = append(s.Dest, n.String())
+	}
+	for _, p := range l.ports {
+		s.Ports = append(s.Ports, p.String())
+	}
+	for _, n := range l.denySource {
+		s.DenySource = append(s.DenySource, n.String())
+	}
+	for _, n := range l.denyDest {
+		s.DenyDest = append(s.DenyDest, n.String())
+	}
+	return s
+}
+
+func (r *Rules) status() rulesStatus {
+	lists := r.current()
+	s := rulesStatus{
+		listStatus:     lists.status(),
+		AllowCountries: r.AllowCountries,
+		DenyCountries:  r.DenyCountries,
+		DenyPrivate:    r.DenyPrivate,
+		Bind:           r.Bind,
+	}
+	if len(lists.users) > 0 {
+		s.Users = make(map[string]listStatus, len(lists.users))
+		for user, l := range lists.users {
+			s.Users[user] = l.status()
+		}
+	}
+	for _, rule := range r.ACL {
+		s.ACL = append(s.ACL, rule.String())
+	}
+	for _, w := range r.AllowHours {
+		s.AllowHours = append(s.AllowHours, w.String())
+	}
+	return s
+}
+
+// activeConnStatus lists the active connections, oldest first.
+func activeConnStatus() []connStatus {
+	activeConns.RLock()
+	conns := make([]*proxyConn, 0, len(activeConns.m))
+	for _, c := range activeConns.m {
+		conns = append(conns, c)
+	}
+	activeConns.RUnlock()
+	sort.Slice(conns, func(i, j int) bool { return conns[i].start.Before(conns[j].start) })
+
+	status := make([]connStatus, 0, len(conns))
+	for _, c := range conns {
+		e := c.event("")
+		status = append(status, connStatus{
+			Conn:      e.Conn,
+			Source:    e.Source,
+			User:      e.User,
+			Command:   e.Command,
+			Dest:      e.Dest,
+			BytesUp:   atomic.LoadUint64(&c.bytesUp),
+			BytesDown: atomic.LoadUint64(&c.bytesDown),
+			Duration:  time.Since(c.start).Seconds(),
+		})
+	}
+	return status
+}
+
+// writeJSON writes v as the JSON body of a response with the given status.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	enc.Encode(v)
+}
+
+// ServeAdmin serves the admin API on the listener, which should only be
+// reachable by those allowed to manage the proxy, such as a Unix socket
+// with restrictive permissions.  It answers:
+//
+//	GET /connections   the active connections
+//	GET /rules         the rules in effect
+//	POST /reload       calls reload, as if the process had received a SIGHUP
+func ServeAdmin(l net.Listener, rules *Rules, reload func() error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/connections", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "use GET"})
+			return
+		}
+		writeJSON(w, http.StatusOK, activeConnStatus())
+	})
+	mux.HandleFunc("/rules", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "use GET"})
+			return
+		}
+		writeJSON(w, http.StatusOK, rules.status())
+	})
+	mux.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "use POST"})
+			return
+		}
+		log.Printf("info: reloading on request from the admin socket")
+		if err := reload(); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "reloaded"})
+	})
+
+	hs := &http.Server{
+		Handler:      mux,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+
+	log.Printf("info: serving admin API on: %s", l.Addr())
+	go func() {
+		if err := hs.Serve(l); err != nil {
+			log.Printf("error: could not serve admin API: %s", err)
+		}
+	}()
+}
@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/armon/go-socks5"
+)
+
+// parseCredential splits a "user:pass" string into its two components.
+func parseCredential(value string) (string, string, error) {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", fmt.Errorf("credential must be of the form user:pass")
+	}
+	return parts[0], parts[1], nil
+}
+
+// MakeCredentials builds a credential store from a list of "user:pass"
+// strings.
+func MakeCredentials(values []string) (socks5.StaticCredentials, error) {
+	creds := make(socks5.StaticCredentials)
+	for _, v := range values {
+		user, pass, err := parseCredential(v)
+		if err != nil {
+			return nil, err
+		}
+		creds[user] = pass
+	}
+	return creds, nil
+}
+
+// ReadCredentialsFile reads a file of "user:pass" lines.  Blank lines and
+// lines starting with '#' are ignored.
+func ReadCredentialsFile(path string) (socks5.StaticCredentials, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	creds := make(socks5.StaticCredentials)
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		user, pass, err := parseCredential(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, lineno, err)
+		}
+		creds[user] = pass
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+// Credentials is a socks5.CredentialStore combining credentials given on the
+// command line with those loaded from a file, which can be reloaded while
+// the server is running.
+type Credentials struct {
+	static socks5.StaticCredentials
+	path   string
+
+	mu    sync.RWMutex
+	creds socks5.StaticCredentials
+}
+
+func NewCredentials(static socks5.StaticCredentials, path string) *Credentials {
+	return &Credentials{
+		static: static,
+		path:   path,
+		creds:  static,
+	}
+}
+
+// Reload re-reads the credentials file, if any.  On error, the previously
+// loaded credentials are kept.
+func (c *Credentials) Reload() error {
+	if c.path == "" {
+		return nil
+	}
+
+	loaded, err := ReadCredentialsFile(c.path)
+	if err != nil {
+		return err
+	}
+	for user, pass := range c.static {
+		loaded[user] = pass
+	}
+
+	c.mu.Lock()
+	c.creds = loaded
+	c.mu.Unlock()
+	return nil
+}
+
+// Len returns the number of users that can currently authenticate.
+func (c *Credentials) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.creds)
+}
+
+func (c *Credentials) Valid(user, password string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.creds.Valid(user, password)
+}
@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxBanSources is how many sources with recent failures are tracked before
+// those whose failures are all older than the window are forgotten.
+const maxBanSources = 10000
+
+// Bans temporarily bans source IPs that fail too often, by failing to
+// authenticate or being denied by the rules.  A source that fails Threshold
+// times within Duration is banned for Duration, after which the ban is
+// lifted automatically.  The methods of a nil *Bans do nothing.
+type Bans struct {
+	Threshold int
+	Duration  time.Duration
+
+	mu      sync.Mutex
+	sources map[string]*banState
+}
+
+type banState struct {
+	// failures are the times of the failures within the window
+	failures []time.Time
+
+	// banned is set while the source is banned
+	banned bool
+}
+
+// NewBans returns bans for sources that fail threshold times within
+// duration.
+func NewBans(threshold int, duration time.Duration) *Bans {
+	return &Bans{
+		Threshold: threshold,
+		Duration:  duration,
+		sources:   make(map[string]*banState),
+	}
+}
+
+// Banned returns whether the source IP is currently banned.
+func (b *Bans) Banned(ip net.IP) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s, ok := b.sources[ip.String()]
+	return ok && s.banned
+}
+
+// Fail records a failure for the source IP, banning it if it has now failed
+// too often.
+func (b *Bans) Fail(ip net.IP, reason string) {
+	if b == nil {
+		return
+	}
+	now := time.Now()
+	since := now.Add(-b.Duration)
+	source := ip.String()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.sources) >= maxBanSources {
+		for src, s := range b.sources {
+			if !s.banned && s.failures[len(s.failures)-1].Before(since) {
+				delete(b.sources, src)
+			}
+		}
+	}
+
+	s, ok := b.sources[source]
+	if !ok {
+		s = &banState{}
+		b.sources[source] = s
+	}
+	if s.banned {
+		return
+	}
+
+	// Forget the failures that have left the window
+	i := 0
+	for i < len(s.failures) && s.failures[i].Before(since) {
+		i++
+	}
+	s.failures = append(s.failures[i:], now)
+	if len(s.failures) < b.Threshold {
+		return
+	}
+
+	s.banned = true
+	s.failures = nil
+	metrics.SourcesBanned.Inc()
+	log.Printf("info: banned source src=%q duration=%q reason=%q",
+		source, b.Duration, fmt.Sprintf("%d failures within %s, last: %s", b.Threshold, b.Duration, reason))
+	time.AfterFunc(b.Duration, func() { b.unban(source) })
+}
+
+// unban lifts the ban on the source.
+func (b *Bans) unban(source string) {
+	b.mu.Lock()
+	delete(b.sources, source)
+	b.mu.Unlock()
+
+	metrics.SourcesBanned.Dec()
+	log.Printf("info: lifted ban on source src=%q", source)
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// blocklistTimeout bounds how long fetching the blocklist may take.
+const blocklistTimeout = 30 * time.Second
+
+// Blocklist is a list of denied domains fetched from a URL, which can be
+// re-fetched while in use.  The list is plain text, with one domain pattern
+// per line as accepted by DomainList, and blank lines and lines starting
+// with '#' ignored.
+type Blocklist struct {
+	URL string
+
+	client  *http.Client
+	domains atomic.Value // domainSet
+}
+
+// NewBlocklist returns an empty blocklist to be fetched from the URL by Load.
+func NewBlocklist(url string) *Blocklist {
+	return &Blocklist{
+		URL:    url,
+		client: &http.Client{Timeout: blocklistTimeout},
+	}
+}
+
+// Load fetches the list and swaps it in.  On error, the previous list stays
+// in effect.
+func (b *Blocklist) Load() error {
+	resp, err := b.client.Get(b.URL)
+	if err != nil {
+		return RedactURLError(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching %s: %s", RedactURL(b.URL), resp.Status)
+	}
+
+	domains, invalid, err := readBlocklist(resp.Body)
+	if err != nil {
+		return fmt.Errorf("reading %s: %s", RedactURL(b.URL), err)
+	}
+	if invalid > 0 {
+		log.Printf("warning: skipped %d invalid line(s) in blocklist url=%q", invalid, RedactURL(b.URL))
+	}
+	b.domains.Store(domains)
+
+	log.Printf("info: loaded %d domain(s) from blocklist url=%q", len(domains), RedactURL(b.URL))
+	return nil
+}
+
+// Match returns the pattern in the list matching the name, if any.
+func (b *Blocklist) Match(name string) (string, bool) {
+	domains, _ := b.domains.Load().(domainSet)
+	return domains.Match(name)
+}
+
+// readBlocklist reads a blocklist, returning its patterns and the number of
+// lines that weren't valid patterns.
+func readBlocklist(r io.Reader) (domainSet, int, error) {
+	domains := make(domainSet)
+	var invalid int
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var list DomainList
+		if err := list.Set(line); err != nil {
+			invalid++
+			continue
+		}
+		domains[list[0]] = struct{}{}
+	}
+	return domains, invalid, scanner.Err()
+}
+
+// domainSet holds domain patterns like DomainList, but matches names in time
+// proportional to their number of labels rather than to the number of
+// patterns, for lists too long to check one by one.
+type domainSet map[string]struct{}
+
+// Match returns the pattern matching the given name, if any: the name
+// itself, or a wildcard for one of its parent domains.
+func (s domainSet) Match(name string) (string, bool) {
+	name = normalizeDomain(name)
+	if _, ok := s[name]; ok {
+		return name, true
+	}
+	for i := strings.Index(name, "."); i >= 0; i = strings.Index(name, ".") {
+		name = name[i+1:]
+		if _, ok := s["*."+name]; ok {
+			return "*." + name, true
+		}
+	}
+	return "", false
+}
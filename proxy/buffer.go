@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"io"
+	"sync"
+)
+
+// bufferPool hands out copy buffers of a fixed size, reusing them across
+// connections.
+type bufferPool struct {
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	return &bufferPool{pool: sync.Pool{
+		New: func() interface{} { return make([]byte, size) },
+	}}
+}
+
+func (p *bufferPool) Get() []byte {
+	return p.pool.Get().([]byte)
+}
+
+func (p *bufferPool) Put(buf []byte) {
+	p.pool.Put(buf)
+}
+
+// copy copies from src to dst like io.Copy, but with a buffer from the pool,
+// if there is one.  The writer and reader are hidden behind plain interfaces,
+// since io.CopyBuffer otherwise ignores the buffer in favour of their own
+// ReadFrom or WriteTo methods, which use small buffers of their own.
+func (p *bufferPool) copy(dst io.Writer, src io.Reader) (int64, error) {
+	if p == nil {
+		return io.Copy(dst, src)
+	}
+	buf := p.Get()
+	defer p.Put(buf)
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, buf)
+}
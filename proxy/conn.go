@@ -0,0 +1,453 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-socks5"
+	"golang.org/x/time/rate"
+)
+
+// proxyConn wraps an accepted client connection, counting the bytes relayed
+// through it in each direction and optionally limiting their rate.
+type proxyConn struct {
+	net.Conn
+
+	// id identifies the connection in log lines
+	id string
+
+	bytesUp   uint64
+	bytesDown uint64
+
+	// lastActive is when data was last relayed, in Unix nanoseconds
+	lastActive int64
+
+	// ctx is cancelled when the connection must stop, see stop
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Rate limits for each direction; nil if unlimited
+	upLimit   *rate.Limiter
+	downLimit *rate.Limiter
+
+	// accounting, if not nil, totals the bytes by source and user
+	accounting *Accounting
+
+	// bans, if not nil, is told when the client fails to authenticate
+	bans *Bans
+
+	// start is when the proxy started serving the connection
+	start time.Time
+
+	// requested is closed once the client has made its request, see
+	// requestMade
+	requested     chan struct{}
+	requestedOnce sync.Once
+
+	// gss, if not nil, protects the SOCKS5 messages once the client has
+	// authenticated with GSS-API, see protected
+	gss *gssConn
+
+	// The user the client authenticated as, the host name it asked for, if
+	// any, the command and destination it asked for, and whether the rules
+	// allowed it
+	mu      sync.Mutex
+	user    string
+	host    string
+	command string
+	dest    string
+	allowed bool
+
+	// resolved holds the addresses the host name resolved to when the
+	// client asked for it, which connections are pinned to rather than
+	// resolving the name again
+	resolved []net.IP
+
+	// When the rules decided on the request, and why they denied it
+	decided    time.Time
+	denyReason string
+
+	// Why the connection was stopped, if it was, and the destination
+	// connections to close along with it
+	reason  string
+	targets []net.Conn
+}
+
+var lastConnID uint64
+
+// newProxyConn wraps a connection, with a context derived from ctx, limiting
+// it to rateLimit bytes per second in each direction unless rateLimit is
+// zero.
+func newProxyConn(ctx context.Context, conn net.Conn, rateLimit uint64) *proxyConn {
+	pc := &proxyConn{
+		Conn:       conn,
+		id:         strconv.FormatUint(atomic.AddUint64(&lastConnID, 1), 36),
+		start:      time.Now(),
+		lastActive: time.Now().UnixNano(),
+		requested:  make(chan struct{}),
+	}
+	pc.ctx, pc.cancel = context.WithCancel(ctx)
+	if rateLimit > 0 {
+		pc.upLimit = newRateLimiter(rateLimit)
+		pc.downLimit = newRateLimiter(rateLimit)
+	}
+	return pc
+}
+
+// Read reads data sent by the client, on its way to the destination.
+func (c *proxyConn) Read(p []byte) (int, error) {
+	if c.upLimit != nil && len(p) > c.upLimit.Burst() {
+		p = p[:c.upLimit.Burst()]
+	}
+
+	n, err := c.Conn.Read(p)
+	c.countUp(n)
+
+	if c.upLimit != nil && n > 0 {
+		// Stop waiting if the connection is stopped
+		if werr := c.upLimit.WaitN(c.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+// countUp counts n bytes read from the client.
+func (c *proxyConn) countUp(n int) {
+	if n <= 0 {
+		return
+	}
+	atomic.AddUint64(&c.bytesUp, uint64(n))
+	c.touch()
+	metrics.BytesUp.Add(float64(n))
+	c.accounting.add(c, uint64(n), 0)
+}
+
+// countDown counts n bytes written to the client.
+func (c *proxyConn) countDown(n int) {
+	if n <= 0 {
+		return
+	}
+	atomic.AddUint64(&c.bytesDown, uint64(n))
+	c.touch()
+	metrics.BytesDown.Add(float64(n))
+	c.accounting.add(c, 0, uint64(n))
+}
+
+// Write writes data from the destination back to the client.
+func (c *proxyConn) Write(p []byte) (int, error) {
+	if c.downLimit == nil {
+		n, err := c.Conn.Write(p)
+		c.countDown(n)
+		return n, err
+	}
+
+	// Write in chunks no larger than the limiter's burst size
+	var written int
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > c.downLimit.Burst() {
+			chunk = chunk[:c.downLimit.Burst()]
+		}
+		if err := c.downLimit.WaitN(c.ctx, len(chunk)); err != nil {
+			return written, err
+		}
+
+		n, err := c.Conn.Write(chunk)
+		written += n
+		c.countDown(n)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// setUser records the user the client authenticated as.
+func (c *proxyConn) setUser(user string) {
+	c.mu.Lock()
+	c.user = user
+	c.mu.Unlock()
+}
+
+// authUser returns the user the client authenticated as, or the empty string if
+// it didn't authenticate.
+func (c *proxyConn) authUser() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.user
+}
+
+// setHost records the host name the client asked to connect to, before it
+// is resolved.
+func (c *proxyConn) setHost(host string) {
+	c.mu.Lock()
+	c.host = host
+	c.mu.Unlock()
+}
+
+// requestedHost returns the host name the client asked to connect to, or the
+// empty string if it gave an IP address.
+func (c *proxyConn) requestedHost() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.host
+}
+
+// setResolved records the addresses the requested host name resolved to.
+func (c *proxyConn) setResolved(ips []net.IP) {
+	c.mu.Lock()
+	c.resolved = ips
+	c.mu.Unlock()
+}
+
+// resolvedAddrs returns the addresses the requested host name resolved to,
+// the first of which is the one the client's request was checked with.
+func (c *proxyConn) resolvedAddrs() []net.IP {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.resolved
+}
+
+// setDest records the command and destination of the connection, whether
+// it was allowed and, if not, why.
+func (c *proxyConn) setDest(command, dest string, allowed bool, denyReason string) {
+	c.mu.Lock()
+	c.command, c.dest, c.allowed = command, dest, allowed
+	c.decided, c.denyReason = time.Now(), denyReason
+	c.mu.Unlock()
+	c.requestMade()
+}
+
+// requestMade records that the client has completed the handshake and made
+// its request, which stops the handshake timeout.
+func (c *proxyConn) requestMade() {
+	c.requestedOnce.Do(func() { close(c.requested) })
+}
+
+// destResult returns the command and destination of the connection and the
+// outcome of the request: "allowed", "denied", or "error" if the client never
+// got as far as asking for a destination that the rules could check.
+func (c *proxyConn) destResult() (command, dest, result string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case c.dest == "":
+		return "CONNECT", "-", "error"
+	case c.allowed:
+		return c.command, c.dest, "allowed"
+	default:
+		return c.command, c.dest, "denied"
+	}
+}
+
+// setTCPOptions applies the configured keep-alive and Nagle settings to the
+// connection, if it is a TCP connection.  Connections forwarded over SSH
+// aren't.
+func (s *Server) setTCPOptions(conn net.Conn) {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+
+	switch {
+	case s.conf.TCPKeepAlive > 0:
+		tcp.SetKeepAlive(true)
+		tcp.SetKeepAlivePeriod(s.conf.TCPKeepAlive)
+	case s.conf.TCPKeepAlive < 0:
+		tcp.SetKeepAlive(false)
+	}
+	tcp.SetNoDelay(!s.conf.TCPDelay)
+}
+
+// protected returns conn, through which the connection is served, wrapped to
+// protect its messages if GSS-API authentication agrees to.
+func (c *proxyConn) protected(conn net.Conn) net.Conn {
+	if c.gss == nil {
+		return conn
+	}
+	c.gss.Conn = conn
+	return c.gss
+}
+
+// connCredentials wraps a credential store to record the user on the
+// connection once it has authenticated.
+type connCredentials struct {
+	socks5.CredentialStore
+	conn *proxyConn
+}
+
+func (c connCredentials) Valid(user, password string) bool {
+	if !c.CredentialStore.Valid(user, password) {
+		if addr, ok := c.conn.RemoteAddr().(*net.TCPAddr); ok {
+			c.conn.bans.Fail(addr.IP, fmt.Sprintf("authentication failed for user %q", user))
+		}
+		return false
+	}
+	c.conn.setUser(user)
+	return true
+}
+
+// connResolver wraps a name resolver to record the requested host name on
+// the connection, so that the rules can log it alongside the resolved IP, and
+// to pin the connection to the addresses it resolves to.  With all set, the
+// name's other addresses are resolved along with it, for dialing them in
+// parallel.
+type connResolver struct {
+	socks5.NameResolver
+	conn *proxyConn
+	all  bool
+}
+
+func (r connResolver) Resolve(name string) (net.IP, error) {
+	r.conn.setHost(name)
+	ip, err := r.NameResolver.Resolve(name)
+	if err != nil {
+		return nil, err
+	}
+
+	ips := []net.IP{ip}
+	if r.all {
+		others, err := resolveAll(r.NameResolver, name)
+		if err != nil {
+			log.Printf("debug: conn=%s could not resolve other addresses domain=%q error=%q", r.conn.id, name, err)
+		}
+		for _, other := range others {
+			if !other.Equal(ip) {
+				ips = append(ips, other)
+			}
+		}
+	}
+	r.conn.setResolved(ips)
+
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = ip.String()
+	}
+	log.Printf("debug: conn=%s pinned connection to resolved address host=%q ip=%q", r.conn.id, name, strings.Join(addrs, ","))
+	return ip, nil
+}
+
+// activeConns maps the client address of each active connection to the
+// connection, so that callbacks from the SOCKS server which only see
+// addresses can find out which connection they concern.
+var activeConns = struct {
+	sync.RWMutex
+	m map[string]*proxyConn
+}{m: make(map[string]*proxyConn)}
+
+func (c *proxyConn) register() {
+	activeConns.Lock()
+	activeConns.m[c.RemoteAddr().String()] = c
+	activeConns.Unlock()
+}
+
+func (c *proxyConn) unregister() {
+	activeConns.Lock()
+	delete(activeConns.m, c.RemoteAddr().String())
+	activeConns.Unlock()
+}
+
+// lookupConn returns the active connection from the given client address,
+// or nil if there is none.
+func lookupConn(ip net.IP, port int) *proxyConn {
+	activeConns.RLock()
+	defer activeConns.RUnlock()
+	return activeConns.m[hostPort(ip, port)]
+}
+
+// connID returns the ID of the active connection from the given client
+// address, for use in log lines.
+func connID(ip net.IP, port int) string {
+	if c := lookupConn(ip, port); c != nil {
+		return c.id
+	}
+	return "-"
+}
+
+type connContextKey struct{}
+
+// withConn returns a context carrying the given connection, derived from its
+// own context, so that dials and listens made for it are cancelled when it
+// stops.
+func withConn(c *proxyConn) context.Context {
+	return context.WithValue(c.ctx, connContextKey{}, c)
+}
+
+// connFromContext returns the connection carried by the context, if any.
+func connFromContext(ctx context.Context) (*proxyConn, bool) {
+	c, ok := ctx.Value(connContextKey{}).(*proxyConn)
+	return c, ok
+}
+
+// connLogWriter tags lines logged by the SOCKS server with a connection ID.
+// Any "[LEVEL] " header is kept at the front, so that the log level is still
+// recognized.
+type connLogWriter struct {
+	id string
+	w  io.Writer
+}
+
+func (w *connLogWriter) Write(p []byte) (int, error) {
+	var i int
+	if bytes.HasPrefix(p, []byte("[")) {
+		if j := bytes.Index(p, []byte("] ")); j >= 0 {
+			i = j + 2
+		}
+	}
+
+	line := make([]byte, 0, len(p)+len(w.id)+6)
+	line = append(line, p[:i]...)
+	line = append(line, "conn="+w.id+" "...)
+	line = append(line, p[i:]...)
+	if _, err := w.w.Write(line); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// bufferedConn is a net.Conn whose reads come from a bufio.Reader wrapping
+// the connection, so that bytes peeked from it aren't lost.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// relay copies data in both directions between the client and the target
+// until either side is done, or the connection is stopped.  Reads from the
+// client come from r, which may hold data already buffered from the client
+// connection.
+func (s *Server) relay(client *proxyConn, r io.Reader, target net.Conn) {
+	done := make(chan struct{}, 2)
+
+	go func() {
+		n, _ := s.buffers.copy(target, r)
+		log.Printf("trace: conn=%s copied to target bytes=%d", client.id, n)
+		done <- struct{}{}
+	}()
+	go func() {
+		n, _ := s.buffers.copy(client, target)
+		log.Printf("trace: conn=%s copied to client bytes=%d", client.id, n)
+		done <- struct{}{}
+	}()
+
+	select {
+	case <-done:
+	case <-client.ctx.Done():
+	}
+}
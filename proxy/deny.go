@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// DenyMode is how the client of a request denied by the rules is answered.
+type DenyMode string
+
+const (
+	// DenyReject replies with an error, as the protocol expects.
+	DenyReject DenyMode = "reject"
+
+	// DenyDrop closes the connection without replying.
+	DenyDrop DenyMode = "drop"
+
+	// DenyTarpit holds the connection open without replying, discarding
+	// whatever the client sends, then closes it.
+	DenyTarpit DenyMode = "tarpit"
+)
+
+// ParseDenyMode parses a deny mode: "reject", "drop" or "tarpit".
+func ParseDenyMode(s string) (DenyMode, error) {
+	switch mode := DenyMode(s); mode {
+	case DenyReject, DenyDrop, DenyTarpit:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown deny mode %q, expected reject, drop or tarpit", s)
+}
+
+// mode returns the deny mode in effect, which defaults to DenyReject.
+func (r *Rules) mode() DenyMode {
+	if r.DenyMode == "" {
+		return DenyReject
+	}
+	return r.DenyMode
+}
+
+// silence closes the connection of a denied request without a reply, after
+// holding it open for TarpitDuration in tarpit mode, so that the error reply
+// the SOCKS server then writes goes nowhere.  It does nothing in reject
+// mode.
+func (r *Rules) silence(c *proxyConn) {
+	switch r.mode() {
+	case DenyTarpit:
+		// Ends early if the client gives up, or the connection is closed
+		// on shutdown
+		c.SetReadDeadline(time.Now().Add(r.TarpitDuration))
+		io.Copy(ioutil.Discard, c)
+		c.Close()
+	case DenyDrop:
+		c.Close()
+	}
+}
+
+// DenyReason classifies why a request was denied, for the metrics.  The
+// reasons logged say more, but would make too many distinct label values.
+type DenyReason string
+
+const (
+	ReasonSourceNotAllowed DenyReason = "source-not-allowed"
+	ReasonDestNotAllowed   DenyReason = "dest-not-allowed"
+	ReasonPortNotAllowed   DenyReason = "port-not-allowed"
+	ReasonSourceDenied     DenyReason = "source-denied"
+	ReasonDestDenied       DenyReason = "dest-denied"
+	ReasonRule             DenyReason = "rule"
+	ReasonHours            DenyReason = "hours"
+	ReasonCountry          DenyReason = "country"
+	ReasonPrivate          DenyReason = "private"
+	ReasonBind             DenyReason = "bind"
+	ReasonBanned           DenyReason = "banned"
+	ReasonDomain           DenyReason = "domain"
+	ReasonBlocklist        DenyReason = "blocklist"
+	ReasonSNI              DenyReason = "sni"
+)
+
+// denyReasons lists every DenyReason, in the order they are exported.
+var denyReasons = []string{
+	string(ReasonSourceNotAllowed),
+	string(ReasonDestNotAllowed),
+	string(ReasonPortNotAllowed),
+	string(ReasonSourceDenied),
+	string(ReasonDestDenied),
+	string(ReasonRule),
+	string(ReasonHours),
+	string(ReasonCountry),
+	string(ReasonPrivate),
+	string(ReasonBind),
+	string(ReasonBanned),
+	string(ReasonDomain),
+	string(ReasonBlocklist),
+	string(ReasonSNI),
+}
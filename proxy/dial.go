@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// dial connects to the destination of a proxied connection, giving up after
+// the configured dial timeout.  Connections that are refused or time out are
+// retried up to DialRetries times.
+func (s *Server) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if s.conf.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.conf.DialTimeout)
+		defer cancel()
+	}
+
+	id := "-"
+	c, ok := connFromContext(ctx)
+	if ok {
+		id = c.id
+		c.requestMade()
+	}
+
+	delay := minDialRetryDelay
+	for attempt := 0; ; attempt++ {
+		conn, err := s.dialOnce(ctx, id, network, addr)
+		if err == nil && c != nil {
+			// Close the destination along with the client when the
+			// connection is stopped
+			c.addTarget(conn)
+			if s.conf.SNIFilter != nil {
+				conn = &sniConn{Conn: conn, client: c, filter: s.conf.SNIFilter}
+			}
+		}
+		if err == nil || attempt >= s.conf.DialRetries || !retryableDialError(err) {
+			return conn, err
+		}
+
+		log.Printf("debug: conn=%s retrying connection in %s dst=%q attempt=%d", id, delay, addr, attempt+1)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, err
+		}
+		if delay *= 2; delay > maxDialRetryDelay {
+			delay = maxDialRetryDelay
+		}
+	}
+}
+
+// Bounds of the backoff between dial retries
+const (
+	minDialRetryDelay = 100 * time.Millisecond
+	maxDialRetryDelay = 2 * time.Second
+)
+
+// retryableDialError returns whether a failed connection attempt may succeed
+// if tried again: the destination refused it or didn't answer in time.
+func retryableDialError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		// The dial timeout or the client gave up, not the destination
+		return false
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// dialOnce makes a single attempt to connect to the destination, directly or
+// through the upstream proxy.
+func (s *Server) dialOnce(ctx context.Context, id, network, addr string) (net.Conn, error) {
+	d := net.Dialer{KeepAlive: s.conf.TCPKeepAlive}
+	if s.conf.LocalAddr != nil {
+		d.LocalAddr = s.conf.LocalAddr
+	}
+	if upstream := s.conf.Upstream; upstream != nil {
+		conn, via, err := upstream.DialContext(ctx, &d, network, addr)
+		if err != nil {
+			log.Printf("debug: conn=%s could not connect through upstream proxies dst=%q error=%q", id, addr, err)
+			return nil, err
+		}
+		log.Printf("info: conn=%s connected dst=%q via=%q local=%q", id, addr, via, conn.LocalAddr())
+		s.setTCPOptions(conn)
+		return s.capture(ctx, conn, addr), nil
+	}
+
+	dial := d.DialContext
+	if s.conf.Dial != nil {
+		dial = s.conf.Dial
+	}
+
+	var conn net.Conn
+	var err error
+	if addrs := s.dialCandidates(ctx, addr); len(addrs) > 1 {
+		log.Printf("debug: conn=%s racing connections dst=%q", id, strings.Join(addrs, ","))
+		conn, err = dialParallel(ctx, dial, network, addrs)
+	} else {
+		conn, err = dial(ctx, network, addr)
+	}
+	if err != nil {
+		log.Printf("debug: conn=%s could not connect dst=%q error=%q", id, addr, err)
+		return nil, err
+	}
+	log.Printf("debug: conn=%s connected dst=%q local=%q", id, conn.RemoteAddr(), conn.LocalAddr())
+	s.setTCPOptions(conn)
+	return s.capture(ctx, conn, conn.RemoteAddr().String()), nil
+}
+
+// bindTimeout bounds how long a BIND request waits for the inbound connection.
+const bindTimeout = 2 * time.Minute
+
+// listen opens the listener for a BIND request, which stops accepting if no
+// connection arrives within bindTimeout.
+func (s *Server) listen(ctx context.Context, network, addr string) (net.Listener, error) {
+	id := "-"
+	if c, ok := connFromContext(ctx); ok {
+		id = c.id
+		c.requestMade()
+	}
+
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		log.Printf("debug: conn=%s could not listen for BIND addr=%q error=%q", id, addr, err)
+		return nil, err
+	}
+	if tl, ok := l.(*net.TCPListener); ok {
+		tl.SetDeadline(time.Now().Add(bindTimeout))
+	}
+	log.Printf("info: conn=%s listening for BIND addr=%q", id, l.Addr())
+	return l, nil
+}
+
+// CheckLocalIP returns an error unless the IP is assigned to one of this
+// host's network interfaces.
+func CheckLocalIP(ip net.IP) error {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if n, ok := addr.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not assigned to any local interface", ip)
+}
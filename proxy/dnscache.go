@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"container/list"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/armon/go-socks5"
+)
+
+// negativeCacheTTL is the longest a failed lookup is cached for, so that a
+// name that briefly fails to resolve doesn't stay unreachable for long.
+const negativeCacheTTL = 5 * time.Second
+
+// CachingResolver is a socks5.NameResolver that remembers the results of
+// lookups by another resolver for a fixed time, evicting the least recently
+// used names once it is full.  Failed lookups are remembered too, for
+// negativeCacheTTL or the TTL if that is shorter.
+type CachingResolver struct {
+	next socks5.NameResolver
+	ttl  time.Duration
+	size int
+
+	mu      sync.Mutex
+	entries map[cacheKey]*list.Element
+	lru     *list.List // of *cacheEntry, most recently used first
+}
+
+// cacheKey identifies a lookup: the first address of a name, as returned by
+// Resolve, is cached separately from all of its addresses.
+type cacheKey struct {
+	name string
+	all  bool
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+// NewCachingResolver returns a resolver caching up to size names resolved by
+// next for ttl.
+func NewCachingResolver(next socks5.NameResolver, ttl time.Duration, size int) *CachingResolver {
+	return &CachingResolver{
+		next:    next,
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[cacheKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (r *CachingResolver) Resolve(name string) (net.IP, error) {
+	ips, err := r.lookup(cacheKey{normalizeDomain(name), false}, func() ([]net.IP, error) {
+		ip, err := r.next.Resolve(name)
+		if err != nil {
+			return nil, err
+		}
+		return []net.IP{ip}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ips[0], nil
+}
+
+func (r *CachingResolver) ResolveAll(name string) ([]net.IP, error) {
+	return r.lookup(cacheKey{normalizeDomain(name), true}, func() ([]net.IP, error) {
+		return resolveAll(r.next, name)
+	})
+}
+
+// lookup returns the cached result for the key if it hasn't expired, and
+// otherwise calls resolve and caches its result.
+func (r *CachingResolver) lookup(key cacheKey, resolve func() ([]net.IP, error)) ([]net.IP, error) {
+	now := time.Now()
+
+	r.mu.Lock()
+	if elem, ok := r.entries[key]; ok {
+		e := elem.Value.(*cacheEntry)
+		if now.Before(e.expires) {
+			r.lru.MoveToFront(elem)
+			r.mu.Unlock()
+			log.Printf("trace: resolved from cache domain=%q", key.name)
+			return e.ips, e.err
+		}
+		r.lru.Remove(elem)
+		delete(r.entries, key)
+	}
+	r.mu.Unlock()
+
+	// Resolve without holding the lock, so that a slow lookup doesn't hold
+	// up others.  Concurrent lookups of the same name may both go through.
+	ips, err := resolve()
+
+	ttl := r.ttl
+	if err != nil && ttl > negativeCacheTTL {
+		ttl = negativeCacheTTL
+	}
+	e := &cacheEntry{key: key, ips: ips, err: err, expires: now.Add(ttl)}
+
+	r.mu.Lock()
+	if elem, ok := r.entries[key]; ok {
+		r.lru.Remove(elem)
+	}
+	r.entries[key] = r.lru.PushFront(e)
+	for r.lru.Len() > r.size {
+		oldest := r.lru.Back()
+		r.lru.Remove(oldest)
+		delete(r.entries, oldest.Value.(*cacheEntry).key)
+	}
+	r.mu.Unlock()
+
+	return ips, err
+}
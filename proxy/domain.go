@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/armon/go-socks5"
+)
+
+// DomainList is a flag holding domain names, which may be exact names like
+// "example.com" or wildcards like "*.example.com" matching any subdomain.
+type DomainList []string
+
+func (d *DomainList) String() string {
+	return fmt.Sprintf("%+v", *d)
+}
+
+func (d *DomainList) Set(value string) error {
+	pattern := normalizeDomain(value)
+	if pattern == "" || pattern == "*." || strings.Contains(strings.TrimPrefix(pattern, "*."), "*") {
+		return fmt.Errorf("invalid domain pattern: %s", value)
+	}
+	*d = append(*d, pattern)
+	return nil
+}
+
+// Match returns the first pattern matching the given name, if any.
+func (d DomainList) Match(name string) (string, bool) {
+	name = normalizeDomain(name)
+	for _, pattern := range d {
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(name, pattern[1:]) {
+				return pattern, true
+			}
+		} else if name == pattern {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+func normalizeDomain(name string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+}
+
+// DomainResolver is a socks5.NameResolver that checks the requested hostname
+// against the domain allow and deny lists, and the blocklist if any, before
+// resolving it.
+type DomainResolver struct {
+	Allow     DomainList
+	Deny      DomainList
+	Blocklist *Blocklist
+	Next      socks5.NameResolver
+
+	// DryRun logs the names it would deny, marking the lines "dry-run",
+	// but resolves them anyway.
+	DryRun bool
+}
+
+func (r DomainResolver) Resolve(name string) (net.IP, error) {
+	if kind, reason := r.denied(name); kind != "" && r.DryRun {
+		log.Printf("info: dry-run: would deny connection domain=%q reason=%q", name, reason)
+	} else if kind != "" {
+		log.Printf("info: denied connection domain=%q reason=%q", name, reason)
+		metrics.denied(kind)
+		return nil, fmt.Errorf("domain %s is denied", name)
+	}
+	return r.Next.Resolve(name)
+}
+
+// denied checks a host name against the lists, returning the kind of reason
+// and the reason it is denied, or empty strings if it is allowed.
+func (r DomainResolver) denied(name string) (DenyReason, string) {
+	if pattern, ok := r.Deny.Match(name); ok {
+		return ReasonDomain, "matches deny rule " + pattern
+	}
+	if r.Blocklist != nil {
+		if pattern, ok := r.Blocklist.Match(name); ok {
+			return ReasonBlocklist, "matches blocklist entry " + pattern
+		}
+	}
+	if len(r.Allow) > 0 {
+		if _, ok := r.Allow.Match(name); !ok {
+			return ReasonDomain, "does not match any allow rule"
+		}
+	}
+	return "", ""
+}
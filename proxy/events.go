@@ -0,0 +1,238 @@
+package proxy
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// eventBuffer is how many events a subscriber may fall behind by before it
+// is dropped.
+const eventBuffer = 256
+
+// bytesEventInterval is how often "bytes" events report the traffic of
+// active connections.
+const bytesEventInterval = time.Second
+
+// Event is something that happened to a connection, as streamed to
+// subscribers.  Type is "connect" when the rules allow a request, "deny"
+// when they don't, "bytes" for the progress of an active connection, and
+// "close" when it has closed, with the same outcome as the access log.
+type Event struct {
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	Conn      string    `json:"conn"`
+	Source    string    `json:"src"`
+	User      string    `json:"user,omitempty"`
+	Command   string    `json:"command,omitempty"`
+	Dest      string    `json:"dst,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	Result    string    `json:"result,omitempty"`
+	BytesUp   uint64    `json:"bytes_up,omitempty"`
+	BytesDown uint64    `json:"bytes_down,omitempty"`
+	Duration  float64   `json:"duration,omitempty"`
+}
+
+// eventHub fans events out to subscribers.  Subscribers that can't keep up
+// are dropped, so that publishing never blocks the proxy.
+type eventHub struct {
+	mu          sync.Mutex
+	subscribers map[chan []byte]struct{}
+
+	// count is the number of subscribers, so that events needn't be built
+	// when there are none
+	count int32
+}
+
+var events = &eventHub{subscribers: make(map[chan []byte]struct{})}
+
+// active returns whether anyone is subscribed.
+func (h *eventHub) active() bool {
+	return atomic.LoadInt32(&h.count) > 0
+}
+
+func (h *eventHub) subscribe() chan []byte {
+	ch := make(chan []byte, eventBuffer)
+	h.mu.Lock()
+	h.subscribers[ch] = struct{}{}
+	atomic.StoreInt32(&h.count, int32(len(h.subscribers)))
+	h.mu.Unlock()
+	return ch
+}
+
+// unsubscribe removes the subscriber and closes its channel, unless it was
+// already dropped.
+func (h *eventHub) unsubscribe(ch chan []byte) {
+	h.mu.Lock()
+	h.remove(ch)
+	h.mu.Unlock()
+}
+
+func (h *eventHub) remove(ch chan []byte) {
+	if _, ok := h.subscribers[ch]; ok {
+		delete(h.subscribers, ch)
+		close(ch)
+		atomic.StoreInt32(&h.count, int32(len(h.subscribers)))
+	}
+}
+
+// publish sends the event to every subscriber.
+func (h *eventHub) publish(e *Event) {
+	if !h.active() {
+		return
+	}
+	e.Time = time.Now()
+	msg, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subscribers {
+		select {
+		case ch <- msg:
+		default:
+			log.Printf("warning: dropped event subscriber that fell %d events behind", eventBuffer)
+			h.remove(ch)
+		}
+	}
+}
+
+// publishBytes sends a "bytes" event for each active connection whose
+// traffic has changed since last time.
+func (h *eventHub) publishBytes(last map[*proxyConn][2]uint64) {
+	activeConns.RLock()
+	conns := make([]*proxyConn, 0, len(activeConns.m))
+	for _, c := range activeConns.m {
+		conns = append(conns, c)
+	}
+	activeConns.RUnlock()
+
+	seen := make(map[*proxyConn]bool, len(conns))
+	for _, c := range conns {
+		seen[c] = true
+		counts := [2]uint64{atomic.LoadUint64(&c.bytesUp), atomic.LoadUint64(&c.bytesDown)}
+		if counts == last[c] {
+			continue
+		}
+		last[c] = counts
+		e := c.event("bytes")
+		e.Result = ""
+		h.publish(&e)
+	}
+	for c := range last {
+		if !seen[c] {
+			delete(last, c)
+		}
+	}
+}
+
+// event returns an event of the given type for the connection, filled in
+// with what is known about it so far.  The result is only meaningful once
+// the connection has closed.
+func (c *proxyConn) event(typ string) Event {
+	command, dest, result := c.destResult()
+	if dest == "-" {
+		command, dest = "", ""
+	}
+	return Event{
+		Type:      typ,
+		Conn:      c.id,
+		Source:    c.RemoteAddr().String(),
+		User:      c.authUser(),
+		Command:   command,
+		Dest:      dest,
+		Result:    result,
+		BytesUp:   atomic.LoadUint64(&c.bytesUp),
+		BytesDown: atomic.LoadUint64(&c.bytesDown),
+	}
+}
+
+// ServeHTTP streams events to a WebSocket client, one JSON object per text
+// message.
+func (h *eventHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, rw, err := upgradeWebSocket(w, r)
+	if err != nil {
+		log.Printf("debug: rejected event subscriber src=%q error=%q", r.RemoteAddr, err)
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Time{})
+
+	ch := h.subscribe()
+	defer h.unsubscribe(ch)
+	log.Printf("info: event subscriber connected src=%q", r.RemoteAddr)
+	defer log.Printf("info: event subscriber disconnected src=%q", r.RemoteAddr)
+
+	// Stop when the client closes the connection
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			opcode, err := readWebSocketFrame(rw)
+			if err != nil || opcode == wsClose {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case msg, ok := <-ch:
+			if !ok {
+				writeWebSocketFrame(conn, wsClose, nil)
+				return
+			}
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := writeWebSocketFrame(conn, wsText, msg); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+// ServeEvents starts an HTTP server streaming connection events over a
+// WebSocket on /events, and returns it so that it can be closed.
+func ServeEvents(l net.Listener) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/events", events)
+
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		last := make(map[*proxyConn][2]uint64)
+		for range time.Tick(bytesEventInterval) {
+			if events.active() {
+				events.publishBytes(last)
+			}
+		}
+	}()
+
+	if !isLoopback(l.Addr()) {
+		log.Printf("warning: serving events on a non-loopback address, which anyone who can reach it can watch: %s", l.Addr())
+	}
+	log.Printf("info: serving events on: %s", l.Addr())
+	go func() {
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Printf("error: could not serve events: %s", err)
+		}
+	}()
+	return srv
+}
+
+// isLoopback returns whether a listener's address can only be reached from
+// this host: a loopback address or a Unix socket.
+func isLoopback(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	return !ok || tcp.IP.IsLoopback()
+}
@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/armon/go-socks5"
+)
+
+// connectionAttemptDelay is how long a connection attempt gets before the
+// next address is tried alongside it, as recommended by RFC 8305.
+const connectionAttemptDelay = 250 * time.Millisecond
+
+// multiResolver is implemented by resolvers that can return every address of
+// a name, for dialing them in parallel.
+type multiResolver interface {
+	ResolveAll(name string) ([]net.IP, error)
+}
+
+func (r NetResolver) ResolveAll(name string) ([]net.IP, error) {
+	addrs, err := r.Resolver.LookupIPAddr(context.Background(), name)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ips, nil
+}
+
+// ResolveAll resolves the name with the next resolver.  The name was already
+// checked against the domain lists when it was first resolved.
+func (r DomainResolver) ResolveAll(name string) ([]net.IP, error) {
+	return resolveAll(r.Next, name)
+}
+
+// resolveAll returns every address of a name, using the resolver if it can
+// and the system resolver otherwise.
+func resolveAll(r socks5.NameResolver, name string) ([]net.IP, error) {
+	if mr, ok := r.(multiResolver); ok {
+		return mr.ResolveAll(name)
+	}
+	return NetResolver{Resolver: net.DefaultResolver}.ResolveAll(name)
+}
+
+// dialCandidates returns the addresses to race for a connection to addr, in
+// the order to try them, or nil if addr should just be dialed on its own.
+// The candidates are the other addresses the host name the client asked for
+// resolved to along with addr, as far as the rules allow connecting to them.
+// The name isn't resolved again, so that it can't be rebound in between.
+func (s *Server) dialCandidates(ctx context.Context, addr string) []string {
+	c, ok := connFromContext(ctx)
+	if !s.conf.DialParallel || !ok || c.requestedHost() == "" {
+		return nil
+	}
+	client, ok := c.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	resolved := net.ParseIP(host)
+	port, err := strconv.Atoi(portStr)
+	if resolved == nil || err != nil {
+		return nil
+	}
+
+	// The address the rules have already checked goes first in its family
+	allowed := []net.IP{resolved}
+	for _, ip := range c.resolvedAddrs() {
+		if !ip.Equal(resolved) && s.allowedAlternate(c, client, ip, port) {
+			allowed = append(allowed, ip)
+		}
+	}
+
+	var addrs []string
+	for _, ip := range interleaveFamilies(allowed) {
+		addrs = append(addrs, net.JoinHostPort(ip.String(), portStr))
+	}
+	return addrs
+}
+
+// allowedAlternate returns whether the rules allow a connection to another
+// address of the requested host.
+func (s *Server) allowedAlternate(c *proxyConn, client *net.TCPAddr, ip net.IP, port int) bool {
+	if rules, ok := s.config.Rules.(*Rules); ok {
+		// Check quietly, since this isn't a request of its own
+		kind, _ := rules.denied(c.authUser(), client.IP, ip, port)
+		return kind == ""
+	}
+	return s.config.Rules.AllowConnect(ip, port, client.IP, client.Port)
+}
+
+// interleaveFamilies orders addresses alternating between IPv6 and IPv4,
+// starting with IPv6, and otherwise keeping their order.
+func interleaveFamilies(ips []net.IP) []net.IP {
+	var v6, v4 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	ordered := make([]net.IP, 0, len(ips))
+	for len(v6) > 0 || len(v4) > 0 {
+		if len(v6) > 0 {
+			ordered, v6 = append(ordered, v6[0]), v6[1:]
+		}
+		if len(v4) > 0 {
+			ordered, v4 = append(ordered, v4[0]), v4[1:]
+		}
+	}
+	return ordered
+}
+
+// dialParallel connects to the first of the addresses to answer, starting
+// another attempt whenever the previous one fails or has been going for
+// connectionAttemptDelay.  This is RFC 8305's "happy eyeballs", so that a
+// broken IPv6 path doesn't stall connections to dual-stack hosts.
+func dialParallel(ctx context.Context, dial func(context.Context, string, string) (net.Conn, error), network string, addrs []string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(addrs))
+
+	var next, pending int
+	start := func() {
+		addr := addrs[next]
+		next++
+		pending++
+		go func() {
+			conn, err := dial(ctx, network, addr)
+			results <- result{conn, err}
+		}()
+	}
+
+	start()
+	timer := time.NewTimer(connectionAttemptDelay)
+	defer timer.Stop()
+
+	var firstErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// Close any connections that lost the race
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(addrs) {
+				start()
+				timer.Reset(connectionAttemptDelay)
+			}
+		case <-timer.C:
+			if next < len(addrs) {
+				start()
+				timer.Reset(connectionAttemptDelay)
+			}
+		}
+	}
+	return nil, firstErr
+}
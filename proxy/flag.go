@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type StringSlice []string
+
+func (s *StringSlice) String() string {
+	return fmt.Sprintf("%+v", *s)
+}
+
+func (s *StringSlice) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// IPNetSlice is a flag that accepts either single IP addresses or CIDR
+// ranges.  A single IP is stored as a network containing only that address.
+// A value of "@path" reads more entries from the file at path.
+type IPNetSlice []*net.IPNet
+
+func (s *IPNetSlice) String() string {
+	return fmt.Sprintf("%+v", *s)
+}
+
+func (s *IPNetSlice) Set(value string) error {
+	if strings.HasPrefix(value, "@") {
+		return s.readFile(value[1:])
+	}
+
+	n, err := parseIPNet(value)
+	if err != nil {
+		return err
+	}
+	*s = append(*s, n)
+	return nil
+}
+
+// readFile adds the IPs and CIDR ranges in a file, one per line.  Blank
+// lines and anything after a '#' are ignored.
+func (s *IPNetSlice) readFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+
+		n, err := parseIPNet(line)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", path, lineno, err)
+		}
+		*s = append(*s, n)
+	}
+	return scanner.Err()
+}
+
+// Contains returns whether the given IP is in any of the networks.
+func (s IPNetSlice) Contains(ip net.IP) bool {
+	for _, n := range s {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseIPNet(value string) (*net.IPNet, error) {
+	if strings.Contains(value, "/") {
+		_, n, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR: %s", value)
+		}
+		return n, nil
+	}
+
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address: %s", value)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// PortRange is an inclusive range of TCP ports.
+type PortRange struct {
+	Low, High int
+}
+
+func (r PortRange) String() string {
+	if r.Low == r.High {
+		return strconv.Itoa(r.Low)
+	}
+	return fmt.Sprintf("%d-%d", r.Low, r.High)
+}
+
+// PortRangeSlice is a flag that accepts single ports or ranges like
+// "8000-8100", or comma-separated lists of them like "80,443,8000-8100".
+type PortRangeSlice []PortRange
+
+func (s *PortRangeSlice) String() string {
+	return fmt.Sprintf("%+v", *s)
+}
+
+func (s *PortRangeSlice) Set(value string) error {
+	var ranges []PortRange
+	for _, v := range strings.Split(value, ",") {
+		r, err := parsePortRange(strings.TrimSpace(v))
+		if err != nil {
+			return err
+		}
+		ranges = append(ranges, r)
+	}
+	*s = append(*s, ranges...)
+	return nil
+}
+
+// Contains returns whether the given port is in any of the ranges.
+func (s PortRangeSlice) Contains(port int) bool {
+	for _, r := range s {
+		if port >= r.Low && port <= r.High {
+			return true
+		}
+	}
+	return false
+}
+
+func parsePortRange(value string) (PortRange, error) {
+	low, high := value, value
+	if i := strings.Index(value, "-"); i >= 0 {
+		low, high = value[:i], value[i+1:]
+	}
+
+	var (
+		r   PortRange
+		err error
+	)
+	if r.Low, err = parsePort(low); err != nil {
+		return r, fmt.Errorf("invalid port range: %s", value)
+	}
+	if r.High, err = parsePort(high); err != nil {
+		return r, fmt.Errorf("invalid port range: %s", value)
+	}
+	if r.Low > r.High {
+		return r, fmt.Errorf("invalid port range: %s", value)
+	}
+	return r, nil
+}
+
+func parsePort(value string) (int, error) {
+	port, err := strconv.ParseUint(value, 10, 16)
+	if err != nil {
+		return 0, err
+	}
+	return int(port), nil
+}
+
+// ByteSize is a flag holding a number of bytes, which accepts suffixes like
+// "KB", "MB" and "GB" (powers of 1024).
+type ByteSize uint64
+
+func (b *ByteSize) String() string {
+	return strconv.FormatUint(uint64(*b), 10)
+}
+
+func (b *ByteSize) Set(value string) error {
+	s := strings.ToUpper(strings.TrimSpace(value))
+	s = strings.TrimSuffix(s, "B")
+
+	multiplier := uint64(1)
+	if len(s) > 0 {
+		switch s[len(s)-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		}
+		if multiplier != 1 {
+			s = s[:len(s)-1]
+		}
+	}
+
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid size: %s", value)
+	}
+	*b = ByteSize(n * multiplier)
+	return nil
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeFile writes a file in a temporary directory and returns its path.
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestIPNetSliceFile(t *testing.T) {
+	path := writeFile(t, "ips.txt", `# Office networks
+10.0.0.0/8
+  192.0.2.1   # gateway
+
+2001:db8::/32
+	2001:db8::1 #
+`)
+
+	var s IPNetSlice
+	for _, v := range []string{"198.51.100.1", "@" + path, "203.0.113.0/24"} {
+		if err := s.Set(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []string{"198.51.100.1/32", "10.0.0.0/8", "192.0.2.1/32", "2001:db8::/32", "2001:db8::1/128", "203.0.113.0/24"}
+	if len(s) != len(want) {
+		t.Fatalf("got %v, want %v", s, want)
+	}
+	for i, n := range s {
+		if n.String() != want[i] {
+			t.Errorf("entry %d is %s, want %s", i, n, want[i])
+		}
+	}
+}
+
+func TestIPNetSliceFileErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{"bad-ip.txt", "10.0.0.1\n\n# comment\nexample.com\n", ":4: invalid IP address: example.com"},
+		{"bad-cidr.txt", "10.0.0.0/33\n", ":1: invalid CIDR: 10.0.0.0/33"},
+		{"nested.txt", "10.0.0.1\n@other.txt\n", ":2: invalid IP address: @other.txt"},
+		{"two-per-line.txt", "# 10.0.0.1\n10.0.0.1 10.0.0.2\n", ":2: invalid IP address: 10.0.0.1 10.0.0.2"},
+	}
+
+	for _, tt := range tests {
+		path := writeFile(t, tt.name, tt.content)
+		var s IPNetSlice
+		err := s.Set("@" + path)
+		if err == nil {
+			t.Errorf("%s: read without error", tt.name)
+			continue
+		}
+		if want := path + tt.err; err.Error() != want {
+			t.Errorf("%s: got error %q, want %q", tt.name, err, want)
+		}
+	}
+}
+
+func TestIPNetSliceMissingFile(t *testing.T) {
+	var s IPNetSlice
+	err := s.Set("@" + filepath.Join(t.TempDir(), "missing.txt"))
+	if !os.IsNotExist(err) {
+		t.Errorf("got error %v, want one saying the file doesn't exist", err)
+	}
+	if err != nil && !strings.Contains(err.Error(), "missing.txt") {
+		t.Errorf("error %q doesn't name the file", err)
+	}
+}
+
+func TestPortRangeSlice(t *testing.T) {
+	var s PortRangeSlice
+	for _, v := range []string{"22", "80,443", "8000-8100, 9000"} {
+		if err := s.Set(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := PortRangeSlice{{22, 22}, {80, 80}, {443, 443}, {8000, 8100}, {9000, 9000}}
+	if !reflect.DeepEqual(s, want) {
+		t.Errorf("got %v, want %v", s, want)
+	}
+
+	for _, v := range []string{"80,", "80,http", "443,8100-8000", "443,65536"} {
+		s := PortRangeSlice{{22, 22}}
+		if err := s.Set(v); err == nil {
+			t.Errorf("%q: set without error", v)
+		} else if len(s) != 1 {
+			t.Errorf("%q: partly set to %v", v, s)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	maxminddb "github.com/oschwald/maxminddb-golang"
+)
+
+// GeoIP looks up the country of IP addresses in a MaxMind DB (MMDB) file,
+// such as GeoLite2-Country.mmdb.
+type GeoIP struct {
+	db *maxminddb.Reader
+
+	mu    sync.Mutex
+	cache map[string]string
+}
+
+// geoIPCacheSize bounds the number of cached lookups; the cache is simply
+// emptied when it fills up.
+const geoIPCacheSize = 10000
+
+// geoIPRecord is the part of a database record that's needed to find the
+// country.
+type geoIPRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+// OpenGeoIP opens a MaxMind DB file.
+func OpenGeoIP(path string) (*GeoIP, error) {
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return &GeoIP{db: db, cache: make(map[string]string)}, nil
+}
+
+// Country returns the ISO 3166-1 country code of the IP, or the empty
+// string if the database doesn't know it.
+func (g *GeoIP) Country(ip net.IP) (string, error) {
+	key := string(ip.To16())
+
+	g.mu.Lock()
+	country, ok := g.cache[key]
+	g.mu.Unlock()
+	if ok {
+		return country, nil
+	}
+
+	country, err := g.lookupCountry(ip)
+	if err != nil {
+		return "", err
+	}
+
+	g.mu.Lock()
+	if len(g.cache) >= geoIPCacheSize {
+		g.cache = make(map[string]string)
+	}
+	g.cache[key] = country
+	g.mu.Unlock()
+	return country, nil
+}
+
+func (g *GeoIP) lookupCountry(ip net.IP) (string, error) {
+	if ip.To4() == nil && g.db.Metadata.IPVersion == 4 {
+		// IPv6 addresses can't be in an IPv4-only database
+		return "", nil
+	}
+
+	var record geoIPRecord
+	if err := g.db.Lookup(ip, &record); err != nil {
+		return "", err
+	}
+	if record.Country.ISOCode != "" {
+		return record.Country.ISOCode, nil
+	}
+	return record.RegisteredCountry.ISOCode, nil
+}
+
+// CountryList is a flag that accepts ISO 3166-1 country codes, like "US".
+type CountryList []string
+
+func (l *CountryList) String() string {
+	return fmt.Sprintf("%v", *l)
+}
+
+func (l *CountryList) Set(value string) error {
+	if len(value) != 2 {
+		return fmt.Errorf("invalid country code: %s", value)
+	}
+	*l = append(*l, strings.ToUpper(value))
+	return nil
+}
+
+// Contains returns whether the country code is in the list.
+func (l CountryList) Contains(country string) bool {
+	for _, c := range l {
+		if c == country {
+			return true
+		}
+	}
+	return false
+}
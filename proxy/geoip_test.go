@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+// mmdbValue encodes a string, an unsigned integer or a map of them in the
+// MaxMind DB data format.
+func mmdbValue(v interface{}) []byte {
+	switch v := v.(type) {
+	case string:
+		return append([]byte{2<<5 | byte(len(v))}, v...)
+	case uint32:
+		return []byte{6<<5 | 4, byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+	case map[string]interface{}:
+		b := []byte{7<<5 | byte(len(v))}
+		for key, value := range v {
+			b = append(b, mmdbValue(key)...)
+			b = append(b, mmdbValue(value)...)
+		}
+		return b
+	}
+	panic("unsupported value")
+}
+
+// writeMMDB writes an IPv4 MaxMind DB file with 24-bit records mapping each
+// network to its record, and returns its path.
+func writeMMDB(t *testing.T, networks map[string]map[string]interface{}) string {
+	t.Helper()
+
+	// Build the search tree, whose records are node numbers, or data
+	// offsets stored as -1-offset, or 0 for no data
+	nodes := [][2]int{{}}
+	var data []byte
+	for cidr, record := range networks {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ones, _ := n.Mask.Size()
+		node := 0
+		for i := 0; i < ones; i++ {
+			bit := n.IP.To4()[i/8] >> (7 - uint(i%8)) & 1
+			if i == ones-1 {
+				nodes[node][bit] = -1 - len(data)
+				data = append(data, mmdbValue(record)...)
+				break
+			}
+			if nodes[node][bit] == 0 {
+				nodes = append(nodes, [2]int{})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+	}
+
+	var buf bytes.Buffer
+	for _, node := range nodes {
+		for _, r := range node {
+			v := len(nodes)
+			if r > 0 {
+				v = r
+			} else if r < 0 {
+				v = len(nodes) + 16 + (-1 - r)
+			}
+			buf.Write([]byte{byte(v >> 16), byte(v >> 8), byte(v)})
+		}
+	}
+	buf.Write(make([]byte, 16))
+	buf.Write(data)
+	buf.WriteString("\xab\xcd\xefMaxMind.com")
+	buf.Write(mmdbValue(map[string]interface{}{
+		"binary_format_major_version": uint32(2),
+		"database_type":               "Test",
+		"ip_version":                  uint32(4),
+		"node_count":                  uint32(len(nodes)),
+		"record_size":                 uint32(24),
+	}))
+
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestGeoIPCountry(t *testing.T) {
+	g, err := OpenGeoIP(writeMMDB(t, map[string]map[string]interface{}{
+		"192.0.2.0/24": {
+			"country":            map[string]interface{}{"iso_code": "US"},
+			"registered_country": map[string]interface{}{"iso_code": "CA"},
+		},
+		"198.51.100.0/24": {
+			"registered_country": map[string]interface{}{"iso_code": "DE"},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"192.0.2.1", "US"},
+		{"198.51.100.200", "DE"},
+		{"203.0.113.1", ""},
+		{"2001:db8::1", ""},
+	}
+
+	// Twice, the second time from the cache
+	for i := 0; i < 2; i++ {
+		for _, tt := range tests {
+			got, err := g.Country(net.ParseIP(tt.ip))
+			if err != nil {
+				t.Errorf("%s: %s", tt.ip, err)
+			} else if got != tt.want {
+				t.Errorf("%s: got country %q, want %q", tt.ip, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestOpenGeoIPInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "invalid.mmdb")
+	if err := ioutil.WriteFile(path, []byte("not a database"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenGeoIP(path); err == nil {
+		t.Error("opened without error")
+	}
+}
@@ -0,0 +1,316 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+)
+
+const socks5Version = 5
+
+// GSS-API authentication, as described in RFC 1961
+const (
+	gssapiAuth    = uint8(1)
+	gssapiVersion = uint8(1)
+
+	// Message types
+	gssAuthMessage       = uint8(1)
+	gssProtectionMessage = uint8(2)
+	gssDataMessage       = uint8(3)
+	gssAbortMessage      = uint8(0xff)
+
+	// Protection levels.  Clear isn't in the RFC, but is what clients
+	// such as curl and Dante ask for to skip per-message protection.
+	gssProtectClear           = uint8(0)
+	gssProtectIntegrity       = uint8(1)
+	gssProtectConfidentiality = uint8(2)
+	gssProtectSelective       = uint8(3)
+
+	// maxGSSChunk bounds how much data is wrapped into each message, so
+	// that the token fits in its 16-bit length.
+	maxGSSChunk = 16 << 10
+)
+
+// GSSAPI accepts Kerberos security contexts from clients, using the service
+// keys in a keytab.
+type GSSAPI struct {
+	Keytab string
+
+	// accept starts accepting a security context from a client
+	accept func() (gssContext, error)
+}
+
+// NewGSSAPI acquires credentials from the keytab to accept security contexts
+// with.  It returns an error if this build doesn't support GSS-API.
+func NewGSSAPI(keytab string) (*GSSAPI, error) {
+	cred, err := gssAcquire(keytab)
+	if err != nil {
+		return nil, err
+	}
+	return &GSSAPI{Keytab: keytab, accept: cred.accept}, nil
+}
+
+// GSSAPIAuthenticator is a socks5.Authenticator for GSS-API authentication.
+// A client that fails to establish a security context, or to agree on the
+// protection of the messages that follow, is sent an abort message and
+// disconnected.
+type GSSAPIAuthenticator struct {
+	GSSAPI *GSSAPI
+
+	// The proxy's own connections record the client's principal, and have
+	// their messages protected as agreed.  Without them, only clients that
+	// ask for no protection can be served.
+	pc      *proxyConn
+	protect *gssConn
+}
+
+func (a GSSAPIAuthenticator) GetCode() uint8 {
+	return gssapiAuth
+}
+
+func (a GSSAPIAuthenticator) Authenticate(reader io.Reader, writer io.Writer) error {
+	if _, err := writer.Write([]byte{socks5Version, gssapiAuth}); err != nil {
+		return err
+	}
+
+	ctx, principal, level, err := a.negotiate(reader, writer)
+	if err != nil {
+		writer.Write([]byte{gssapiVersion, gssAbortMessage})
+		if a.pc != nil {
+			log.Printf("info: conn=%s GSS-API authentication failed error=%q", a.pc.id, err)
+			if addr, ok := a.pc.RemoteAddr().(*net.TCPAddr); ok {
+				a.pc.bans.Fail(addr.IP, "GSS-API authentication failed")
+			}
+		}
+		return err
+	}
+
+	if a.pc != nil {
+		a.pc.setUser(principal)
+		log.Printf("debug: conn=%s GSS-API authenticated principal=%q protection=%d", a.pc.id, principal, level)
+	}
+	if level == gssProtectClear {
+		ctx.Close()
+	} else {
+		a.protect.start(ctx, level == gssProtectConfidentiality)
+	}
+	return nil
+}
+
+// negotiate establishes a security context with the client, then agrees on
+// the protection of the messages that follow, returning the context, the
+// client's principal and the protection level.
+func (a GSSAPIAuthenticator) negotiate(r io.Reader, w io.Writer) (_ gssContext, principal string, level uint8, err error) {
+	ctx, err := a.GSSAPI.accept()
+	if err != nil {
+		return nil, "", 0, err
+	}
+	defer func() {
+		if err != nil {
+			ctx.Close()
+		}
+	}()
+
+	for done := false; !done; {
+		var token, out []byte
+		if token, err = readGSSMessage(r, gssAuthMessage); err != nil {
+			return nil, "", 0, err
+		}
+		if out, done, err = ctx.Accept(token); err != nil {
+			return nil, "", 0, err
+		}
+		if len(out) > 0 {
+			if err = writeGSSMessage(w, gssAuthMessage, out); err != nil {
+				return nil, "", 0, err
+			}
+		}
+	}
+	if principal, err = ctx.Principal(); err != nil {
+		return nil, "", 0, err
+	}
+
+	// The level should be wrapped, but clients in NEC's compatibility mode
+	// send it as a bare octet, and expect the reply the same way.
+	token, err := readGSSMessage(r, gssProtectionMessage)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	bare := len(token) == 1
+	requested := token
+	if !bare {
+		if requested, err = ctx.Unwrap(token); err != nil {
+			return nil, "", 0, fmt.Errorf("could not unwrap protection level: %s", err)
+		}
+	}
+	if len(requested) != 1 {
+		return nil, "", 0, fmt.Errorf("invalid protection level message of %d bytes", len(requested))
+	}
+
+	switch level = requested[0]; level {
+	case gssProtectClear, gssProtectIntegrity, gssProtectConfidentiality:
+	case gssProtectSelective:
+		// Protect every message rather than leave it up to each one
+		level = gssProtectConfidentiality
+	default:
+		return nil, "", 0, fmt.Errorf("unknown protection level %d", level)
+	}
+	if level != gssProtectClear && a.protect == nil {
+		return nil, "", 0, errors.New("message protection isn't available on this connection")
+	}
+
+	reply := []byte{level}
+	if !bare {
+		if reply, err = ctx.Wrap(reply, false); err != nil {
+			return nil, "", 0, fmt.Errorf("could not wrap protection level: %s", err)
+		}
+	}
+	if err = writeGSSMessage(w, gssProtectionMessage, reply); err != nil {
+		return nil, "", 0, err
+	}
+	return ctx, principal, level, nil
+}
+
+// readGSSMessage reads a message of the given type, returning its token.
+func readGSSMessage(r io.Reader, mtyp uint8) ([]byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[0] != gssapiVersion {
+		return nil, fmt.Errorf("unsupported GSS-API message version: %d", header[0])
+	}
+	if header[1] == gssAbortMessage {
+		return nil, errors.New("client aborted GSS-API negotiation")
+	}
+	if header[1] != mtyp {
+		return nil, fmt.Errorf("unexpected GSS-API message type %d, expected %d", header[1], mtyp)
+	}
+
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(r, length); err != nil {
+		return nil, err
+	}
+	token := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(r, token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// writeGSSMessage writes a message of the given type carrying the token.
+func writeGSSMessage(w io.Writer, mtyp uint8, token []byte) error {
+	if len(token) > 0xffff {
+		return fmt.Errorf("GSS-API token of %d bytes is too long", len(token))
+	}
+	msg := make([]byte, 4, 4+len(token))
+	msg[0], msg[1] = gssapiVersion, mtyp
+	binary.BigEndian.PutUint16(msg[2:], uint16(len(token)))
+	_, err := w.Write(append(msg, token...))
+	return err
+}
+
+// gssContext is a security context accepted from a client.
+type gssContext interface {
+	// Accept processes a token from the client, returning the token to
+	// send back, if any, and whether the context is now established.
+	Accept(token []byte) (out []byte, done bool, err error)
+
+	// Principal returns the name the client authenticated as.
+	Principal() (string, error)
+
+	Wrap(msg []byte, confidential bool) ([]byte, error)
+	Unwrap(token []byte) ([]byte, error)
+	Close() error
+}
+
+// gssConn is a connection whose data is, once GSS-API authentication has
+// agreed to protect it, wrapped in data messages.  Until then, it passes
+// data through as it is.
+type gssConn struct {
+	net.Conn
+
+	mu           sync.Mutex
+	ctx          gssContext
+	confidential bool
+
+	// pending holds unwrapped data not read yet
+	pending []byte
+}
+
+// start protects the data from now on with the security context, which the
+// connection closes along with itself.
+func (c *gssConn) start(ctx gssContext, confidential bool) {
+	c.mu.Lock()
+	c.ctx, c.confidential = ctx, confidential
+	c.mu.Unlock()
+}
+
+// context returns the security context, or nil if the data isn't protected.
+func (c *gssConn) context() gssContext {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ctx
+}
+
+func (c *gssConn) Read(b []byte) (int, error) {
+	ctx := c.context()
+	if ctx == nil {
+		return c.Conn.Read(b)
+	}
+	for len(c.pending) == 0 {
+		token, err := readGSSMessage(c.Conn, gssDataMessage)
+		if err != nil {
+			return 0, err
+		}
+		c.mu.Lock()
+		c.pending, err = ctx.Unwrap(token)
+		c.mu.Unlock()
+		if err != nil {
+			return 0, fmt.Errorf("could not unwrap GSS-API message: %s", err)
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *gssConn) Write(b []byte) (int, error) {
+	ctx := c.context()
+	if ctx == nil {
+		return c.Conn.Write(b)
+	}
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > maxGSSChunk {
+			chunk = chunk[:maxGSSChunk]
+		}
+		c.mu.Lock()
+		token, err := ctx.Wrap(chunk, c.confidential)
+		c.mu.Unlock()
+		if err != nil {
+			return written, fmt.Errorf("could not wrap GSS-API message: %s", err)
+		}
+		if err := writeGSSMessage(c.Conn, gssDataMessage, token); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
+
+func (c *gssConn) Close() error {
+	err := c.Conn.Close()
+	c.mu.Lock()
+	if c.ctx != nil {
+		c.ctx.Close()
+		c.ctx = nil
+	}
+	c.mu.Unlock()
+	return err
+}
@@ -0,0 +1,206 @@
+//go:build gssapi && cgo && !windows && !plan9
+// +build gssapi,cgo,!windows,!plan9
+
+package proxy
+
+/*
+#cgo LDFLAGS: -lgssapi_krb5
+
+#include <gssapi/gssapi.h>
+#include <gssapi/gssapi_ext.h>
+#include <stdlib.h>
+
+// socks_gss_acquire acquires credentials to accept contexts for any service
+// principal in the keytab.
+static OM_uint32 socks_gss_acquire(OM_uint32 *minor, char *keytab, gss_cred_id_t *cred) {
+	gss_key_value_element_desc element = { "keytab", keytab };
+	gss_key_value_set_desc store = { 1, &element };
+
+	return gss_acquire_cred_from(minor, GSS_C_NO_NAME, GSS_C_INDEFINITE,
+		GSS_C_NO_OID_SET, GSS_C_ACCEPT, &store, cred, NULL, NULL);
+}
+
+static OM_uint32 socks_gss_accept(OM_uint32 *minor, gss_ctx_id_t *ctx, gss_cred_id_t cred,
+		void *in, size_t inlen, gss_name_t *src, gss_buffer_t out) {
+	gss_buffer_desc input = { inlen, in };
+
+	return gss_accept_sec_context(minor, ctx, cred, &input, GSS_C_NO_CHANNEL_BINDINGS,
+		src, NULL, out, NULL, NULL, NULL);
+}
+
+static OM_uint32 socks_gss_wrap(OM_uint32 *minor, gss_ctx_id_t ctx, int conf,
+		void *in, size_t inlen, gss_buffer_t out) {
+	gss_buffer_desc input = { inlen, in };
+
+	return gss_wrap(minor, ctx, conf, GSS_C_QOP_DEFAULT, &input, NULL, out);
+}
+
+static OM_uint32 socks_gss_unwrap(OM_uint32 *minor, gss_ctx_id_t ctx,
+		void *in, size_t inlen, gss_buffer_t out) {
+	gss_buffer_desc input = { inlen, in };
+
+	return gss_unwrap(minor, ctx, &input, out, NULL, NULL);
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unsafe"
+)
+
+// gssCred holds the credentials that security contexts are accepted with.
+type gssCred struct {
+	cred C.gss_cred_id_t
+}
+
+func gssAcquire(keytab string) (*gssCred, error) {
+	ckeytab := C.CString(keytab)
+	defer C.free(unsafe.Pointer(ckeytab))
+
+	c := &gssCred{}
+	var minor C.OM_uint32
+	if major := C.socks_gss_acquire(&minor, ckeytab, &c.cred); major != C.GSS_S_COMPLETE {
+		return nil, fmt.Errorf("could not acquire credentials from keytab %s: %s", keytab, gssError(major, minor))
+	}
+	return c, nil
+}
+
+func (c *gssCred) accept() (gssContext, error) {
+	return &krb5Context{cred: c.cred}, nil
+}
+
+// krb5Context is a security context accepted with the Kerberos mechanism.
+type krb5Context struct {
+	cred C.gss_cred_id_t
+	ctx  C.gss_ctx_id_t
+	src  C.gss_name_t
+}
+
+func (k *krb5Context) Accept(token []byte) ([]byte, bool, error) {
+	if len(token) == 0 {
+		return nil, false, errors.New("empty GSS-API token")
+	}
+	var (
+		minor C.OM_uint32
+		out   C.gss_buffer_desc
+	)
+	major := C.socks_gss_accept(&minor, &k.ctx, k.cred,
+		unsafe.Pointer(&token[0]), C.size_t(len(token)), &k.src, &out)
+	reply := takeBuffer(&out)
+	switch major {
+	case C.GSS_S_COMPLETE:
+		return reply, true, nil
+	case C.GSS_S_CONTINUE_NEEDED:
+		return reply, false, nil
+	}
+	return nil, false, fmt.Errorf("could not accept security context: %s", gssError(major, minor))
+}
+
+func (k *krb5Context) Principal() (string, error) {
+	var (
+		minor C.OM_uint32
+		name  C.gss_buffer_desc
+	)
+	if major := C.gss_display_name(&minor, k.src, &name, nil); major != C.GSS_S_COMPLETE {
+		return "", fmt.Errorf("could not get client name: %s", gssError(major, minor))
+	}
+	return string(takeBuffer(&name)), nil
+}
+
+func (k *krb5Context) Wrap(msg []byte, confidential bool) ([]byte, error) {
+	if k.ctx == nil {
+		return nil, errors.New("security context is closed")
+	}
+	if len(msg) == 0 {
+		return nil, errors.New("empty message")
+	}
+	conf := C.int(0)
+	if confidential {
+		conf = 1
+	}
+
+	var (
+		minor C.OM_uint32
+		out   C.gss_buffer_desc
+	)
+	if major := C.socks_gss_wrap(&minor, k.ctx, conf, unsafe.Pointer(&msg[0]), C.size_t(len(msg)), &out); major != C.GSS_S_COMPLETE {
+		return nil, gssError(major, minor)
+	}
+	return takeBuffer(&out), nil
+}
+
+func (k *krb5Context) Unwrap(token []byte) ([]byte, error) {
+	if k.ctx == nil {
+		return nil, errors.New("security context is closed")
+	}
+	if len(token) == 0 {
+		return nil, errors.New("empty token")
+	}
+
+	var (
+		minor C.OM_uint32
+		out   C.gss_buffer_desc
+	)
+	if major := C.socks_gss_unwrap(&minor, k.ctx, unsafe.Pointer(&token[0]), C.size_t(len(token)), &out); major != C.GSS_S_COMPLETE {
+		return nil, gssError(major, minor)
+	}
+	return takeBuffer(&out), nil
+}
+
+func (k *krb5Context) Close() error {
+	var minor C.OM_uint32
+	if k.ctx != nil {
+		C.gss_delete_sec_context(&minor, &k.ctx, nil)
+		k.ctx = nil
+	}
+	if k.src != nil {
+		C.gss_release_name(&minor, &k.src)
+		k.src = nil
+	}
+	return nil
+}
+
+// takeBuffer copies a buffer returned by GSS-API and releases it.
+func takeBuffer(buf *C.gss_buffer_desc) []byte {
+	if buf.length == 0 {
+		return nil
+	}
+	b := C.GoBytes(buf.value, C.int(buf.length))
+	var minor C.OM_uint32
+	C.gss_release_buffer(&minor, buf)
+	return b
+}
+
+// gssError describes a GSS-API status and the mechanism's own status.
+func gssError(major, minor C.OM_uint32) error {
+	var msgs []string
+	for _, s := range []struct {
+		code  C.OM_uint32
+		ctype C.int
+	}{{major, C.GSS_C_GSS_CODE}, {minor, C.GSS_C_MECH_CODE}} {
+		if s.code == 0 {
+			continue
+		}
+		var more C.OM_uint32
+		for {
+			var (
+				st  C.OM_uint32
+				buf C.gss_buffer_desc
+			)
+			if C.gss_display_status(&st, s.code, s.ctype, nil, &more, &buf) != C.GSS_S_COMPLETE {
+				break
+			}
+			msgs = append(msgs, string(takeBuffer(&buf)))
+			if more == 0 {
+				break
+			}
+		}
+	}
+	if len(msgs) == 0 {
+		return fmt.Errorf("GSS-API status %#x", uint32(major))
+	}
+	return errors.New(strings.Join(msgs, ": "))
+}
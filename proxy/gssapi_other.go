@@ -0,0 +1,21 @@
+//go:build !gssapi || !cgo || windows || plan9
+// +build !gssapi !cgo windows plan9
+
+package proxy
+
+import (
+	"errors"
+)
+
+var errGSSAPIUnsupported = errors.New("GSS-API authentication requires a build on Unix with cgo and -tags gssapi")
+
+type gssCred struct{}
+
+// gssAcquire returns an error, since this build doesn't support GSS-API.
+func gssAcquire(keytab string) (*gssCred, error) {
+	return nil, errGSSAPIUnsupported
+}
+
+func (c *gssCred) accept() (gssContext, error) {
+	return nil, errGSSAPIUnsupported
+}
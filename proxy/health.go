@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// ServeHealth starts an HTTP server on the listener answering /healthz with
+// 200 OK while the server is accepting connections, and 503 otherwise.  Close
+// the returned server to stop it.
+func ServeHealth(l net.Listener, srv *Server) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if !srv.Serving() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, "unavailable\n")
+			return
+		}
+		io.WriteString(w, "ok\n")
+	})
+
+	hs := &http.Server{
+		Handler:      mux,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+
+	log.Printf("info: serving health checks on: %s", l.Addr())
+	go func() {
+		if err := hs.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Printf("error: could not serve health checks: %s", err)
+		}
+	}()
+	return hs
+}
@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimeWindow is a daily window of time, optionally restricted to certain
+// days of the week.  The end may be earlier than the start, in which case
+// the window wraps around midnight and its days are the days it starts on.
+type TimeWindow struct {
+	// Days the window applies to; all days if nil
+	Days []time.Weekday
+
+	// Start and end, in minutes since midnight.  The end is exclusive.
+	Start, End int
+}
+
+func (w TimeWindow) String() string {
+	s := fmt.Sprintf("%02d:%02d-%02d:%02d", w.Start/60, w.Start%60, w.End/60, w.End%60)
+	if w.Days == nil {
+		return s
+	}
+
+	days := make([]string, len(w.Days))
+	for i, d := range w.Days {
+		days[i] = d.String()[:3]
+	}
+	return strings.Join(days, ",") + " " + s
+}
+
+// Contains returns whether the time falls inside the window.
+func (w TimeWindow) Contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+
+	if w.Start <= w.End {
+		return w.onDay(day) && minute >= w.Start && minute < w.End
+	}
+
+	// The window wraps around midnight: the part after midnight belongs to
+	// the previous day's window.
+	if minute >= w.Start {
+		return w.onDay(day)
+	}
+	return minute < w.End && w.onDay((day+6)%7)
+}
+
+func (w TimeWindow) onDay(day time.Weekday) bool {
+	if w.Days == nil {
+		return true
+	}
+	for _, d := range w.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// TimeWindowSlice is a flag that accepts windows like "09:00-17:00",
+// optionally preceded by days of the week, as in "Mon-Fri 09:00-17:00".
+type TimeWindowSlice []TimeWindow
+
+func (s *TimeWindowSlice) String() string {
+	return fmt.Sprintf("%+v", *s)
+}
+
+func (s *TimeWindowSlice) Set(value string) error {
+	w, err := parseTimeWindow(value)
+	if err != nil {
+		return err
+	}
+	*s = append(*s, w)
+	return nil
+}
+
+// Contains returns whether the time falls inside any of the windows.
+func (s TimeWindowSlice) Contains(t time.Time) bool {
+	for _, w := range s {
+		if w.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseTimeWindow(value string) (TimeWindow, error) {
+	var w TimeWindow
+
+	fields := strings.Fields(value)
+	switch len(fields) {
+	case 1:
+	case 2:
+		days, err := parseWeekdays(fields[0])
+		if err != nil {
+			return w, fmt.Errorf("invalid time window: %s: %s", value, err)
+		}
+		w.Days = days
+		fields = fields[1:]
+	default:
+		return w, fmt.Errorf("invalid time window: %s", value)
+	}
+
+	i := strings.Index(fields[0], "-")
+	if i < 0 {
+		return w, fmt.Errorf("invalid time window: %s", value)
+	}
+
+	var err error
+	if w.Start, err = parseClock(fields[0][:i]); err != nil {
+		return w, fmt.Errorf("invalid time window: %s: %s", value, err)
+	}
+	if w.End, err = parseClock(fields[0][i+1:]); err != nil {
+		return w, fmt.Errorf("invalid time window: %s: %s", value, err)
+	}
+	if w.Start == w.End {
+		return w, fmt.Errorf("invalid time window: %s: window is empty", value)
+	}
+	return w, nil
+}
+
+// parseClock parses a time of day like "09:30" into minutes since midnight.
+// "24:00" is accepted as the end of the day.
+func parseClock(value string) (int, error) {
+	i := strings.Index(value, ":")
+	if i < 0 {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+	hour, err := strconv.Atoi(value[:i])
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+	minute, err := strconv.Atoi(value[i+1:])
+	if err != nil || len(value[i+1:]) != 2 {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+
+	if hour < 0 || minute < 0 || minute > 59 || hour > 24 || (hour == 24 && minute != 0) {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+	return hour*60 + minute, nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// parseWeekdays parses a comma-separated list of days and day ranges, like
+// "Mon-Fri" or "Mon,Wed,Sat-Sun".
+func parseWeekdays(value string) ([]time.Weekday, error) {
+	var days []time.Weekday
+	seen := make(map[time.Weekday]bool)
+
+	for _, part := range strings.Split(value, ",") {
+		first, last := part, part
+		if i := strings.Index(part, "-"); i >= 0 {
+			first, last = part[:i], part[i+1:]
+		}
+
+		from, ok := weekdays[strings.ToLower(first)]
+		if !ok {
+			return nil, fmt.Errorf("unknown day %q", first)
+		}
+		to, ok := weekdays[strings.ToLower(last)]
+		if !ok {
+			return nil, fmt.Errorf("unknown day %q", last)
+		}
+
+		// Ranges may wrap around the end of the week, e.g. Fri-Mon
+		for d := from; ; d = (d + 1) % 7 {
+			if !seen[d] {
+				seen[d] = true
+				days = append(days, d)
+			}
+			if d == to {
+				break
+			}
+		}
+	}
+	return days, nil
+}
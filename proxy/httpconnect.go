@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// serveHTTPConnect handles an HTTP CONNECT request, tunnelling the connection
+// to the requested destination.  The first byte of the request has already
+// been peeked, but not consumed, from r.
+func (s *Server) serveHTTPConnect(conn *proxyConn, r *bufio.Reader) error {
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return fmt.Errorf("failed to read HTTP request: %s", err)
+	}
+
+	if req.Method != http.MethodConnect {
+		httpReply(conn, http.StatusMethodNotAllowed, nil)
+		return fmt.Errorf("unsupported HTTP method: %s", req.Method)
+	}
+
+	// HTTP clients can only authenticate with a username and password, so
+	// if that's not offered, they can't use the proxy at all
+	if s.requireAuth() {
+		creds := s.credentials()
+		user, pass, ok := proxyBasicAuth(req)
+		if creds == nil || !ok || !(connCredentials{creds, conn}).Valid(user, pass) {
+			httpReply(conn, http.StatusProxyAuthRequired, http.Header{
+				"Proxy-Authenticate": {`Basic realm="socks"`},
+			})
+			return fmt.Errorf("HTTP CONNECT request rejected, authentication failed")
+		}
+	}
+
+	host, portStr, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		httpReply(conn, http.StatusBadRequest, nil)
+		return fmt.Errorf("invalid CONNECT destination '%s': %s", req.Host, err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		httpReply(conn, http.StatusBadRequest, nil)
+		return fmt.Errorf("invalid CONNECT destination '%s': bad port", req.Host)
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		resolved, err := connResolver{s.config.Resolver, conn, s.conf.DialParallel}.Resolve(host)
+		if err != nil {
+			httpReply(conn, http.StatusBadGateway, nil)
+			return fmt.Errorf("failed to resolve destination '%s': %s", host, err)
+		}
+		ip = resolved
+	}
+
+	client := conn.RemoteAddr().(*net.TCPAddr)
+	if !s.config.Rules.AllowConnect(ip, int(port), client.IP, client.Port) {
+		httpReply(conn, http.StatusForbidden, nil)
+		return fmt.Errorf("connect to %s blocked by rules", hostPort(ip, int(port)))
+	}
+
+	target, err := s.config.Dial(withConn(conn), "tcp", hostPort(ip, int(port)))
+	if err != nil {
+		httpReply(conn, http.StatusBadGateway, nil)
+		return fmt.Errorf("connect to %s failed: %s", ip, err)
+	}
+	defer target.Close()
+
+	if err := httpReply(conn, http.StatusOK, nil); err != nil {
+		return fmt.Errorf("failed to send reply: %s", err)
+	}
+
+	s.relay(conn, r, target)
+	return nil
+}
+
+// httpReply writes a bodyless HTTP response with the given status.
+func httpReply(conn net.Conn, status int, header http.Header) error {
+	resp := &http.Response{
+		StatusCode: status,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+	}
+	if status != http.StatusOK {
+		// Don't leave the client waiting for a body
+		resp.Close = true
+		resp.ContentLength = 0
+	}
+	return resp.Write(conn)
+}
+
+// proxyBasicAuth returns the username and password from the request's
+// Proxy-Authorization header, if it uses basic authentication.
+func proxyBasicAuth(req *http.Request) (user, pass string, ok bool) {
+	auth := req.Header.Get("Proxy-Authorization")
+	const prefix = "Basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	i := strings.IndexByte(string(decoded), ':')
+	if i < 0 {
+		return "", "", false
+	}
+	return string(decoded[:i]), string(decoded[i+1:]), true
+}
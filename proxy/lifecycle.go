@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// A connection's context is cancelled when it must stop: when it reaches
+// the maximum age, has been idle too long, or the server is shut down
+// without it finishing in time.  Whichever happens first gives the reason
+// it is logged with, and its client and destination connections are then
+// closed together, which ends the relay in both directions.
+
+// reasonShutdown is the reason connections are stopped when the server
+// gives up waiting for them to finish.
+const reasonShutdown = "server is shutting down"
+
+// stop cancels the connection's context, recording why.  The first reason
+// given wins, and an empty reason means the connection finished normally.
+func (c *proxyConn) stop(reason string) {
+	c.mu.Lock()
+	if c.ctx.Err() == nil && c.reason == "" {
+		c.reason = reason
+	}
+	c.mu.Unlock()
+	c.cancel()
+}
+
+// stopReason returns why the connection was stopped, if it was.
+func (c *proxyConn) stopReason() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.reason
+}
+
+// addTarget registers a connection to a destination, to be closed along
+// with the client connection when the connection stops.
+func (c *proxyConn) addTarget(target net.Conn) {
+	c.mu.Lock()
+	stopped := c.ctx.Err() != nil
+	if !stopped {
+		c.targets = append(c.targets, target)
+	}
+	c.mu.Unlock()
+
+	if stopped {
+		target.Close()
+	}
+}
+
+// touch records activity on the connection, for the idle timeout.
+func (c *proxyConn) touch() {
+	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+}
+
+// idle returns how long ago the connection last relayed any data.
+func (c *proxyConn) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.lastActive)))
+}
+
+// watch stops the connection when it reaches the maximum age or idle time,
+// or the client is too slow to make its request, and closes it once it has
+// stopped, for whatever reason.  It returns when
+// the connection has been closed.
+func (s *Server) watch(c *proxyConn) {
+	var age, idle, handshake <-chan time.Time
+	requested := c.requested
+	if s.conf.HandshakeTimeout > 0 {
+		timer := time.NewTimer(s.conf.HandshakeTimeout)
+		defer timer.Stop()
+		handshake = timer.C
+	}
+	if s.conf.MaxConnectionAge > 0 {
+		timer := time.NewTimer(s.conf.MaxConnectionAge)
+		defer timer.Stop()
+		age = timer.C
+	}
+	if s.conf.IdleTimeout > 0 {
+		// Check a few times per timeout, so that connections are closed
+		// not long after they go idle
+		ticker := time.NewTicker(s.conf.IdleTimeout / 4)
+		defer ticker.Stop()
+		idle = ticker.C
+	}
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			c.teardown(s.ctx)
+			return
+		case <-requested:
+			handshake, requested = nil, nil
+		case <-handshake:
+			c.stop("handshake not completed within " + s.conf.HandshakeTimeout.String())
+		case <-age:
+			c.stop("reached maximum connection age of " + s.conf.MaxConnectionAge.String())
+		case <-idle:
+			if c.idle() >= s.conf.IdleTimeout {
+				c.stop("idle for " + s.conf.IdleTimeout.String())
+			}
+		}
+	}
+}
+
+// teardown closes the client and destination connections of a stopped
+// connection, logging why it was stopped unless it finished normally.
+// server is the server's context, which is cancelled on shutdown.
+func (c *proxyConn) teardown(server context.Context) {
+	reason := c.stopReason()
+	if reason == "" && server.Err() != nil {
+		reason = reasonShutdown
+	}
+	if reason != "" {
+		log.Printf("info: conn=%s closing connection src=%q reason=%q", c.id, c.RemoteAddr(), reason)
+	}
+
+	c.mu.Lock()
+	targets := c.targets
+	c.targets = nil
+	c.mu.Unlock()
+
+	c.Close()
+	for _, t := range targets {
+		t.Close()
+	}
+}
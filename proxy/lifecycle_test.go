@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// logBuffer collects what is logged through the standard logger.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLog sends the standard logger's output to a buffer until the test
+// ends.
+func captureLog(t *testing.T) *logBuffer {
+	t.Helper()
+	b := &logBuffer{}
+	output, flags := log.Writer(), log.Flags()
+	log.SetOutput(b)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(output)
+		log.SetFlags(flags)
+	})
+	return b
+}
+
+// assertClosed checks that the other end of a pipe has been closed.
+func assertClosed(t *testing.T, name string, peer net.Conn) {
+	t.Helper()
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := peer.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("%s connection not closed: read returned %v", name, err)
+	}
+}
+
+func TestStopClosesConnections(t *testing.T) {
+	tests := []struct {
+		name   string
+		conf   Config
+		stop   func(s *Server, pc *proxyConn)
+		reason string
+	}{
+		{
+			name:   "maximum age",
+			conf:   Config{MaxConnectionAge: 20 * time.Millisecond},
+			reason: "reached maximum connection age of 20ms",
+		},
+		{
+			name:   "idle timeout",
+			conf:   Config{IdleTimeout: 20 * time.Millisecond},
+			reason: "idle for 20ms",
+		},
+		{
+			name:   "handshake timeout",
+			conf:   Config{HandshakeTimeout: 20 * time.Millisecond},
+			reason: "handshake not completed within 20ms",
+		},
+		{
+			name:   "shutdown",
+			stop:   func(s *Server, pc *proxyConn) { s.cancel() },
+			reason: reasonShutdown,
+		},
+		{
+			name:   "explicit stop",
+			stop:   func(s *Server, pc *proxyConn) { pc.stop("TLS server name denied") },
+			reason: "TLS server name denied",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLog(t)
+			s, err := New(&tt.conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			client, clientPeer := net.Pipe()
+			target, targetPeer := net.Pipe()
+			pc := newProxyConn(s.ctx, client, 0)
+			pc.addTarget(target)
+
+			watched := make(chan struct{})
+			go func() {
+				s.watch(pc)
+				close(watched)
+			}()
+			if tt.stop != nil {
+				tt.stop(s, pc)
+			}
+
+			select {
+			case <-watched:
+			case <-time.After(2 * time.Second):
+				t.Fatal("connection wasn't stopped")
+			}
+			assertClosed(t, "client", clientPeer)
+			assertClosed(t, "destination", targetPeer)
+
+			want := "reason=\"" + tt.reason + "\""
+			if !strings.Contains(logs.String(), want) {
+				t.Errorf("log doesn't contain %s:\n%s", want, logs)
+			}
+		})
+	}
+}
+
+func TestStopCancelsDial(t *testing.T) {
+	captureLog(t)
+
+	// A port nothing listens on, which refuses connections
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	s, err := New(&Config{DialRetries: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, _ := net.Pipe()
+	pc := newProxyConn(s.ctx, client, 0)
+	defer pc.Close()
+
+	dialed := make(chan error, 1)
+	go func() {
+		conn, err := s.dial(withConn(pc), "tcp", addr)
+		if conn != nil {
+			conn.Close()
+		}
+		dialed <- err
+	}()
+
+	// Let it get into the backoff between retries
+	time.Sleep(150 * time.Millisecond)
+	pc.stop("reached maximum connection age of 1s")
+
+	select {
+	case err := <-dialed:
+		if err == nil {
+			t.Error("dial succeeded")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("dial wasn't cancelled when the connection stopped")
+	}
+}
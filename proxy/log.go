@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"io"
+	"log"
+	"os"
+	"sync"
+
+	"comail.io/go/colog"
+)
+
+// NewLogger routes the standard logger through a colog instance writing to
+// standard error, so that "level: " prefixes are recognized, and returns a
+// logger for the SOCKS5 server that goes through it too.  The colog
+// instance can be used to change the level, format and output.
+func NewLogger() (*log.Logger, *colog.CoLog) {
+	// Create logger
+	logger := log.New(stderr, "", 0)
+
+	// Create colog instance
+	cl := colog.NewCoLog(stderr, "", 0)
+
+	// This header is from the SOCKS package, and is actually at the 'Trace'
+	// level, in that it shows all bytes copied
+	colog.AddHeader("[DEBUG] ", colog.LTrace)
+
+	// Overwrite both standard library and custom logger with this colog instance.
+	log.SetOutput(cl)
+	logger.SetOutput(cl)
+
+	// Overwrite flags on stdlib logger
+	log.SetPrefix("")
+	log.SetFlags(0)
+
+	return logger, cl
+}
+
+// stderr is standard error, shared by every logger that writes to it so that
+// their records are written one at a time.
+var stderr io.Writer = &syncWriter{w: os.Stderr}
+
+// syncWriter serializes writes to w.  A single write to a file or pipe can
+// take several system calls, so without it, records logged at the same time
+// by different connections could be spliced together mid-line.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (w *syncWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"bytes"
+	"log"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// chunkedWriter writes each record a few bytes at a time, as a write to a
+// pipe or file can be split into several system calls, giving writes made
+// at the same time the chance to interleave.
+type chunkedWriter struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (w *chunkedWriter) Write(p []byte) (int, error) {
+	for i := 0; i < len(p); i += 4 {
+		end := i + 4
+		if end > len(p) {
+			end = len(p)
+		}
+		w.mu.Lock()
+		w.buf.Write(p[i:end])
+		w.mu.Unlock()
+		runtime.Gosched()
+	}
+	return len(p), nil
+}
+
+func TestConcurrentLogging(t *testing.T) {
+	out := &chunkedWriter{}
+	saved, output, flags, prefix := stderr, log.Writer(), log.Flags(), log.Prefix()
+	stderr = &syncWriter{w: out}
+	t.Cleanup(func() {
+		stderr = saved
+		log.SetOutput(output)
+		log.SetFlags(flags)
+		log.SetPrefix(prefix)
+	})
+
+	const (
+		goroutines = 50
+		records    = 200
+	)
+	socksLogger, _ := NewLogger()
+
+	// A server without a logger of its own writes to standard error
+	// directly, alongside colog
+	srv, err := New(&Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultLogger := srv.config.Logger
+
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < records; i++ {
+				switch i % 3 {
+				case 0:
+					log.Printf("info: conn=%d record=%d %s", g, i, strings.Repeat("x", 40))
+				case 1:
+					socksLogger.Printf("warning: conn=%d record=%d %s", g, i, strings.Repeat("y", 40))
+				default:
+					defaultLogger.Printf("conn=%d record=%d %s", g, i, strings.Repeat("z", 40))
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	well := regexp.MustCompile(`^(?:\[ +info \] |\[ +warn \] |\d{4}/\d\d/\d\d \d\d:\d\d:\d\d )conn=(\d+) record=(\d+) (x{40}|y{40}|z{40})$`)
+	seen := make(map[string]bool)
+	lines := strings.Split(strings.TrimSuffix(out.buf.String(), "\n"), "\n")
+	for _, line := range lines {
+		m := well.FindStringSubmatch(line)
+		if m == nil {
+			t.Fatalf("malformed line: %q", line)
+		}
+		seen[m[1]+"/"+m[2]] = true
+	}
+	if len(lines) != goroutines*records || len(seen) != goroutines*records {
+		t.Errorf("got %d lines, %d of them distinct, want %d", len(lines), len(seen), goroutines*records)
+	}
+}
@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Metrics holds all the metrics exported by the proxy.
+type Metrics struct {
+	ConnectionsAccepted prometheus.Counter
+	ConnectionsDenied   prometheus.Counter
+	Denials             *prometheus.CounterVec
+	ConnectionsServed   *prometheus.CounterVec
+	ConnectionsActive   prometheus.Gauge
+	ConnectionsQueued   prometheus.Gauge
+	SourcesBanned       prometheus.Gauge
+	BytesUp             prometheus.Counter
+	BytesDown           prometheus.Counter
+	ConnectionDuration  prometheus.Histogram
+
+	// bytes holds BytesUp and BytesDown
+	bytes *prometheus.CounterVec
+
+	// active and peak count the open connections, to export and log the
+	// highest number open at once
+	active int64
+	peak   int64
+
+	// accounting, if set, is exported along with the metrics
+	mu         sync.Mutex
+	accounting *Accounting
+}
+
+func newMetrics() *Metrics {
+	bytes := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "socks_bytes_total",
+		Help: "Total number of bytes relayed, by direction.",
+	}, []string{"direction"})
+
+	m := &Metrics{
+		ConnectionsAccepted: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "socks_connections_accepted_total",
+			Help: "Total number of client connections accepted.",
+		}),
+		ConnectionsDenied: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "socks_connections_denied_total",
+			Help: "Total number of connection requests denied by the rules.",
+		}),
+		Denials: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "socks_denials_total",
+			Help: "Total number of requests denied, by the kind of reason.",
+		}, []string{"reason"}),
+		ConnectionsServed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "socks_connections_served_total",
+			Help: "Total number of client connections served, by protocol.",
+		}, []string{"protocol"}),
+		ConnectionsActive: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "socks_connections_active",
+			Help: "Number of client connections currently open.",
+		}),
+		ConnectionsQueued: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "socks_connections_queued",
+			Help: "Number of client connections waiting for a --max-concurrent slot.",
+		}),
+		SourcesBanned: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "socks_sources_banned",
+			Help: "Number of source IPs currently banned by --ban-threshold.",
+		}),
+		BytesUp:   bytes.WithLabelValues("up"),
+		BytesDown: bytes.WithLabelValues("down"),
+		bytes:     bytes,
+		ConnectionDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "socks_connection_duration_seconds",
+			Help:    "Duration of client connections.",
+			Buckets: []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600},
+		}),
+	}
+
+	// Export every label value from the start, even before it is counted
+	for _, reason := range denyReasons {
+		m.Denials.WithLabelValues(reason)
+	}
+	for _, protocol := range servedProtocols {
+		m.ConnectionsServed.WithLabelValues(protocol)
+	}
+	return m
+}
+
+var (
+	metrics = newMetrics()
+
+	// registry holds the metrics served by ServeMetrics.
+	registry = prometheus.NewRegistry()
+)
+
+func init() {
+	registry.MustRegister(
+		metrics.ConnectionsAccepted,
+		metrics.ConnectionsDenied,
+		metrics.Denials,
+		metrics.ConnectionsServed,
+		metrics.ConnectionsActive,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "socks_connections_active_peak",
+			Help: "Highest number of client connections open at once.",
+		}, func() float64 { return float64(metrics.Peak()) }),
+		metrics.ConnectionsQueued,
+		metrics.SourcesBanned,
+		metrics.bytes,
+		metrics.ConnectionDuration,
+		accountingCollector{metrics},
+	)
+}
+
+func (m *Metrics) setAccounting(a *Accounting) {
+	m.mu.Lock()
+	m.accounting = a
+	m.mu.Unlock()
+}
+
+// opened counts a client connection being opened, and closed one being
+// closed.
+func (m *Metrics) opened() {
+	m.ConnectionsActive.Inc()
+	v := atomic.AddInt64(&m.active, 1)
+	for {
+		peak := atomic.LoadInt64(&m.peak)
+		if v <= peak || atomic.CompareAndSwapInt64(&m.peak, peak, v) {
+			return
+		}
+	}
+}
+
+func (m *Metrics) closed() {
+	m.ConnectionsActive.Dec()
+	atomic.AddInt64(&m.active, -1)
+}
+
+// Peak returns the highest number of client connections open at once.
+func (m *Metrics) Peak() int64 {
+	return atomic.LoadInt64(&m.peak)
+}
+
+// denied counts a request denied for the kind of reason.
+func (m *Metrics) denied(reason DenyReason) {
+	m.ConnectionsDenied.Inc()
+	m.Denials.WithLabelValues(string(reason)).Inc()
+}
+
+// counterValue returns the current value of a counter.
+func counterValue(c prometheus.Counter) uint64 {
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		return 0
+	}
+	return uint64(m.GetCounter().GetValue())
+}
+
+// servedProtocols are the label values of ConnectionsServed.
+var servedProtocols = []string{"socks4", "socks5", "http"}
+
+// served returns the number of connections served, which unlike
+// ConnectionsAccepted leaves out those rejected before a request was read.
+func (m *Metrics) served() uint64 {
+	var n uint64
+	for _, protocol := range servedProtocols {
+		n += counterValue(m.ConnectionsServed.WithLabelValues(protocol))
+	}
+	return n
+}
+
+// accountingCollector exports the per-source and per-user byte totals of
+// the accounting table, if there is one.
+type accountingCollector struct {
+	m *Metrics
+}
+
+var accountBytesDesc = prometheus.NewDesc("socks_account_bytes_total",
+	"Total number of bytes relayed, by source IP, user and direction.",
+	[]string{"source", "user", "direction"}, nil)
+
+func (c accountingCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- accountBytesDesc
+}
+
+func (c accountingCollector) Collect(ch chan<- prometheus.Metric) {
+	c.m.mu.Lock()
+	a := c.m.accounting
+	c.m.mu.Unlock()
+	if a == nil {
+		return
+	}
+
+	for _, e := range a.entries() {
+		ch <- prometheus.MustNewConstMetric(accountBytesDesc, prometheus.CounterValue, float64(e.up), e.source, e.user, "up")
+		ch <- prometheus.MustNewConstMetric(accountBytesDesc, prometheus.CounterValue, float64(e.down), e.source, e.user, "down")
+	}
+}
+
+// ServeMetrics starts an HTTP server on the listener exposing the metrics on
+// /metrics.  Close the returned server to stop it.
+func ServeMetrics(l net.Listener) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+	srv := &http.Server{
+		Handler:      mux,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+
+	log.Printf("info: serving metrics on: %s", l.Addr())
+	go func() {
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Printf("error: could not serve metrics: %s", err)
+		}
+	}()
+	return srv
+}
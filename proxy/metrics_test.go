@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestServeMetrics(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := ServeMetrics(l)
+	defer srv.Close()
+
+	a := NewAccounting()
+	a.m[accountKey{source: "192.0.2.1", user: "alice"}] = &accountBytes{up: 100, down: 2000}
+	metrics.setAccounting(a)
+	defer metrics.setAccounting(nil)
+
+	metrics.denied(ReasonCountry)
+	metrics.ConnectionDuration.Observe(2)
+
+	resp, err := http.Get("http://" + l.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		t.Fatalf("got %s with content type %q", resp.Status, resp.Header.Get("Content-Type"))
+	}
+
+	for _, want := range []string{
+		"# TYPE socks_connections_accepted_total counter",
+		"# TYPE socks_connections_active gauge",
+		"# TYPE socks_connections_active_peak gauge",
+		"# TYPE socks_connection_duration_seconds histogram",
+		`socks_connection_duration_seconds_bucket{le="5"}`,
+		`socks_denials_total{reason="country"}`,
+		`socks_denials_total{reason="sni"}`,
+		`socks_connections_served_total{protocol="socks4"}`,
+		`socks_bytes_total{direction="up"}`,
+		`socks_bytes_total{direction="down"}`,
+		`socks_account_bytes_total{direction="up",source="192.0.2.1",user="alice"} 100`,
+		`socks_account_bytes_total{direction="down",source="192.0.2.1",user="alice"} 2000`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics don't contain %s", want)
+		}
+	}
+}
+
+func TestMetricsServed(t *testing.T) {
+	served := metrics.served()
+
+	// Connections rejected before a request is read are only accepted
+	metrics.ConnectionsAccepted.Inc()
+	if got := metrics.served(); got != served {
+		t.Errorf("served %d connection(s) after one was only accepted, want %d", got, served)
+	}
+
+	metrics.ConnectionsServed.WithLabelValues("socks5").Inc()
+	metrics.ConnectionsServed.WithLabelValues("http").Inc()
+	if got := metrics.served(); got != served+2 {
+		t.Errorf("served %d connection(s), want %d", got, served+2)
+	}
+}
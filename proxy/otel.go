@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tuning of the span exporter
+const (
+	// traceExportInterval is how often finished spans are sent
+	traceExportInterval = 5 * time.Second
+
+	// maxPendingSpans bounds the spans waiting to be sent, beyond which
+	// new ones are dropped, so that an unreachable collector can't use up
+	// memory.
+	maxPendingSpans = 4096
+
+	traceExportTimeout = 10 * time.Second
+)
+
+// Tracer exports an OpenTelemetry span for each proxied connection to a
+// collector, over OTLP/HTTP with JSON encoding.  Spans are sent in batches
+// in the background; call Close to send the last of them.
+type Tracer struct {
+	provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+	once     sync.Once
+}
+
+// NewTracer returns a Tracer sending spans to an OTLP/HTTP collector, such as
+// "http://localhost:4318".  Without a path, spans are sent to the standard
+// /v1/traces.  service is the service.name the spans are reported under.
+func NewTracer(endpoint, service string) (*Tracer, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, RedactURLError(err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q, expected http or https", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("no host in %s", RedactURL(endpoint))
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(),
+		otlptracehttp.WithEndpointURL(u.String()),
+		otlptracehttp.WithEncoding(otlptracehttp.EncodingJSON),
+		otlptracehttp.WithTimeout(traceExportTimeout),
+		// Spans that fail to send are dropped rather than retried
+		otlptracehttp.WithRetry(otlptracehttp.RetryConfig{Enabled: false}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		log.Printf("warning: could not export trace spans: %s", err)
+	}))
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter,
+			sdktrace.WithBatchTimeout(traceExportInterval),
+			sdktrace.WithMaxQueueSize(maxPendingSpans),
+			sdktrace.WithExportTimeout(traceExportTimeout),
+		),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", service))),
+	)
+	return &Tracer{
+		provider: provider,
+		tracer:   provider.Tracer("github.com/bmbernie/socks/proxy"),
+	}, nil
+}
+
+// Close sends the spans still pending and stops the exporter.
+func (t *Tracer) Close() {
+	if t == nil {
+		return
+	}
+	t.once.Do(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), traceExportTimeout)
+		defer cancel()
+		if err := t.provider.Shutdown(ctx); err != nil {
+			log.Printf("warning: could not export trace spans: %s", err)
+		}
+	})
+}
+
+// record exports the span for a closed connection that ended at the given
+// time, with an event for the rules' decision, if they made one.  Each
+// connection is a trace of its own.
+func (t *Tracer) record(c *proxyConn, end time.Time) {
+	if t == nil {
+		return
+	}
+
+	command, dest, result := c.destResult()
+	attrs := []attribute.KeyValue{
+		attribute.String("socks.conn", c.id),
+		attribute.String("socks.command", command),
+		attribute.String("socks.result", result),
+		attribute.Int64("socks.bytes_up", int64(atomic.LoadUint64(&c.bytesUp))),
+		attribute.Int64("socks.bytes_down", int64(atomic.LoadUint64(&c.bytesDown))),
+	}
+	attrs = append(attrs, addrAttrs("client", c.RemoteAddr().String())...)
+	if dest != "-" {
+		attrs = append(attrs, addrAttrs("destination", dest)...)
+	}
+	if user := c.authUser(); user != "" {
+		attrs = append(attrs, attribute.String("enduser.id", user))
+	}
+	if reason := c.stopReason(); reason != "" {
+		attrs = append(attrs, attribute.String("socks.close_reason", reason))
+	}
+
+	_, span := t.tracer.Start(context.Background(), "socks "+command,
+		trace.WithNewRoot(),
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithTimestamp(c.start),
+		trace.WithAttributes(attrs...),
+	)
+
+	c.mu.Lock()
+	decided, denyReason := c.decided, c.denyReason
+	c.mu.Unlock()
+	if !decided.IsZero() {
+		eventAttrs := []attribute.KeyValue{attribute.Bool("socks.allowed", result == "allowed")}
+		if denyReason != "" {
+			eventAttrs = append(eventAttrs, attribute.String("socks.reason", denyReason))
+		}
+		span.AddEvent("socks.decision", trace.WithTimestamp(decided), trace.WithAttributes(eventAttrs...))
+	}
+	if result == "error" {
+		span.SetStatus(codes.Error, "")
+	}
+	span.End(trace.WithTimestamp(end))
+}
+
+// addrAttrs returns the address and port attributes for a host:port.
+func addrAttrs(prefix, hostport string) []attribute.KeyValue {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return []attribute.KeyValue{attribute.String(prefix+".address", hostport)}
+	}
+	attrs := []attribute.KeyValue{attribute.String(prefix+".address", host)}
+	if p, err := strconv.Atoi(port); err == nil {
+		attrs = append(attrs, attribute.Int(prefix+".port", p))
+	}
+	return attrs
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTracer(t *testing.T) {
+	var mu sync.Mutex
+	var paths, bodies []string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+	}))
+	defer collector.Close()
+
+	tracer, err := NewTracer(collector.URL, "socks-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, _ := net.Pipe()
+	c := newProxyConn(context.Background(), &tcpClientConn{
+		Conn:   client,
+		remote: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 61003},
+	}, 0)
+	c.setDest("CONNECT", "198.51.100.1:443", false, "destination not allowed")
+	tracer.record(c, time.Now())
+	tracer.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(bodies) != 1 {
+		t.Fatalf("collector got %d request(s), want 1", len(bodies))
+	}
+	if paths[0] != "/v1/traces" {
+		t.Errorf("spans sent to %s, want /v1/traces", paths[0])
+	}
+	for _, want := range []string{
+		`"socks-test"`,
+		`"socks CONNECT"`,
+		`"socks.result"`,
+		`"denied"`,
+		`"client.address"`,
+		`"192.0.2.1"`,
+		`"destination.port"`,
+		`"socks.decision"`,
+		`"destination not allowed"`,
+	} {
+		if !strings.Contains(bodies[0], want) {
+			t.Errorf("spans don't contain %s: %s", want, bodies[0])
+		}
+	}
+}
+
+func TestNewTracerErrors(t *testing.T) {
+	for _, endpoint := range []string{"localhost:4318", "ftp://localhost:4318", "http://"} {
+		if _, err := NewTracer(endpoint, "socks"); err == nil {
+			t.Errorf("%s: created without error", endpoint)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bounds of the time a user must wait before trying again after failing to
+// authenticate with PAM, which doubles with each consecutive failure
+const (
+	minPAMBackoff = time.Second
+	maxPAMBackoff = time.Minute
+
+	// maxPAMBackoffUsers is how many users with recent failures are
+	// tracked before those whose backoff has expired are forgotten.
+	maxPAMBackoffUsers = 10000
+)
+
+// PAMCredentials is a socks5.CredentialStore that checks usernames and
+// passwords against a PAM service.  To slow down guessing, a user who fails
+// to authenticate is rejected without asking PAM until a backoff expires.
+type PAMCredentials struct {
+	Service string
+
+	mu      sync.Mutex
+	backoff map[string]*pamBackoff
+}
+
+type pamBackoff struct {
+	failures int
+	until    time.Time
+}
+
+// NewPAMCredentials returns a credential store using the PAM service.  It
+// returns an error if this build doesn't support PAM.
+func NewPAMCredentials(service string) (*PAMCredentials, error) {
+	if err := pamSupported(); err != nil {
+		return nil, err
+	}
+	return &PAMCredentials{
+		Service: service,
+		backoff: make(map[string]*pamBackoff),
+	}, nil
+}
+
+func (p *PAMCredentials) Valid(user, password string) bool {
+	if wait := p.waiting(user); wait > 0 {
+		log.Printf("info: PAM authentication rate limited user=%q retry_in=%q", user, wait)
+		return false
+	}
+
+	// The C strings passed to PAM can't contain NULs
+	if strings.ContainsRune(user, 0) || strings.ContainsRune(password, 0) {
+		log.Printf("info: PAM authentication failed user=%q service=%q error=%q", user, p.Service, "invalid character")
+		p.failed(user)
+		return false
+	}
+
+	if err := pamAuthenticate(p.Service, user, password); err != nil {
+		wait := p.failed(user)
+		log.Printf("info: PAM authentication failed user=%q service=%q error=%q retry_in=%q", user, p.Service, err, wait)
+		return false
+	}
+
+	p.mu.Lock()
+	delete(p.backoff, user)
+	p.mu.Unlock()
+	return true
+}
+
+// waiting returns how long the user must still wait before trying again.
+func (p *PAMCredentials) waiting(user string) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if b, ok := p.backoff[user]; ok {
+		return time.Until(b.until).Round(time.Millisecond)
+	}
+	return 0
+}
+
+// failed records a failure for the user, returning how long it must wait
+// before trying again.
+func (p *PAMCredentials) failed(user string) time.Duration {
+	now := time.Now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.backoff) >= maxPAMBackoffUsers {
+		for u, b := range p.backoff {
+			if now.After(b.until) {
+				delete(p.backoff, u)
+			}
+		}
+	}
+
+	b, ok := p.backoff[user]
+	if !ok {
+		b = &pamBackoff{}
+		p.backoff[user] = b
+	}
+	b.failures++
+
+	wait := maxPAMBackoff
+	if b.failures <= 6 {
+		wait = minPAMBackoff << uint(b.failures-1)
+	}
+	b.until = now.Add(wait)
+	return wait
+}
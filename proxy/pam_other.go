@@ -0,0 +1,19 @@
+//go:build !pam || !cgo || windows || plan9
+// +build !pam !cgo windows plan9
+
+package proxy
+
+import (
+	"errors"
+)
+
+var errPAMUnsupported = errors.New("PAM authentication requires a build on Unix with cgo and -tags pam")
+
+// pamSupported returns an error, since this build doesn't support PAM.
+func pamSupported() error {
+	return errPAMUnsupported
+}
+
+func pamAuthenticate(service, user, password string) error {
+	return errPAMUnsupported
+}
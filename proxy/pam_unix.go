@@ -0,0 +1,110 @@
+//go:build pam && cgo && !windows && !plan9
+// +build pam,cgo,!windows,!plan9
+
+package proxy
+
+/*
+#cgo LDFLAGS: -lpam
+
+#include <security/pam_appl.h>
+#include <stdlib.h>
+#include <string.h>
+
+// socks_pam_conv answers PAM's password prompts with the password passed as
+// appdata_ptr.  Informational messages are ignored, and any other prompt
+// fails the conversation.
+static int socks_pam_conv(int n, const struct pam_message **msg,
+		struct pam_response **resp, void *appdata_ptr) {
+	struct pam_response *r;
+	int i;
+
+	if (n <= 0 || n > PAM_MAX_NUM_MSG) {
+		return PAM_CONV_ERR;
+	}
+	r = calloc(n, sizeof(*r));
+	if (r == NULL) {
+		return PAM_BUF_ERR;
+	}
+	for (i = 0; i < n; i++) {
+		switch (msg[i]->msg_style) {
+		case PAM_PROMPT_ECHO_OFF:
+			r[i].resp = strdup((const char *)appdata_ptr);
+			if (r[i].resp == NULL) {
+				goto fail;
+			}
+			break;
+		case PAM_ERROR_MSG:
+		case PAM_TEXT_INFO:
+			break;
+		default:
+			goto fail;
+		}
+	}
+	*resp = r;
+	return PAM_SUCCESS;
+
+fail:
+	for (i = 0; i < n; i++) {
+		if (r[i].resp != NULL) {
+			memset(r[i].resp, 0, strlen(r[i].resp));
+			free(r[i].resp);
+		}
+	}
+	free(r);
+	return PAM_CONV_ERR;
+}
+
+// socks_pam_authenticate authenticates the user and checks that its account
+// is usable, copying PAM's description of any error into errbuf.
+static int socks_pam_authenticate(const char *service, const char *user,
+		char *password, char *errbuf, size_t errlen) {
+	struct pam_conv conv = { socks_pam_conv, password };
+	pam_handle_t *pamh = NULL;
+	int status;
+
+	status = pam_start(service, user, &conv, &pamh);
+	if (status == PAM_SUCCESS) {
+		status = pam_authenticate(pamh, PAM_SILENT | PAM_DISALLOW_NULL_AUTHTOK);
+	}
+	if (status == PAM_SUCCESS) {
+		status = pam_acct_mgmt(pamh, PAM_SILENT | PAM_DISALLOW_NULL_AUTHTOK);
+	}
+	if (status != PAM_SUCCESS) {
+		strncpy(errbuf, pam_strerror(pamh, status), errlen - 1);
+		errbuf[errlen - 1] = '\0';
+	}
+	if (pamh != NULL) {
+		pam_end(pamh, status);
+	}
+	return status;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"unsafe"
+)
+
+func pamSupported() error {
+	return nil
+}
+
+// pamAuthenticate checks the user's password and account with the PAM
+// service.
+func pamAuthenticate(service, user, password string) error {
+	cService, cUser, cPassword := C.CString(service), C.CString(user), C.CString(password)
+	defer C.free(unsafe.Pointer(cService))
+	defer C.free(unsafe.Pointer(cUser))
+	defer func() {
+		C.memset(unsafe.Pointer(cPassword), 0, C.size_t(len(password)))
+		C.free(unsafe.Pointer(cPassword))
+	}()
+
+	var errbuf [256]C.char
+	status := C.socks_pam_authenticate(cService, cUser, cPassword, &errbuf[0], C.size_t(len(errbuf)))
+	if status != C.PAM_SUCCESS {
+		return errors.New(C.GoString(&errbuf[0]))
+	}
+	return nil
+}
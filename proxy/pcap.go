@@ -0,0 +1,282 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// pcap-ng block types, and the link type of packets that start with their
+// IP header
+const (
+	pcapSectionHeader   = 0x0A0D0D0A
+	pcapInterface       = 0x00000001
+	pcapEnhancedPacket  = 0x00000006
+	pcapLinkTypeRaw     = 101
+	pcapByteOrderMagic  = 0x1A2B3C4D
+	pcapMaxSegmentBytes = 65000
+)
+
+// TCP flags used in the synthetic segments
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+// PcapWriter writes the data relayed through the proxy to a pcap-ng file, as
+// TCP segments between each client and its destination, so that it can be
+// examined with tools like Wireshark.  The IP and TCP headers are made up:
+// only the addresses, ports and payloads are real.
+type PcapWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	failed bool
+}
+
+// NewPcapWriter writes the pcap-ng file header to w and returns a writer
+// for the packets that follow.
+func NewPcapWriter(w io.Writer) (*PcapWriter, error) {
+	shb := make([]byte, 28)
+	binary.LittleEndian.PutUint32(shb[0:], pcapSectionHeader)
+	binary.LittleEndian.PutUint32(shb[4:], uint32(len(shb)))
+	binary.LittleEndian.PutUint32(shb[8:], pcapByteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[12:], 1) // version 1.0
+	binary.LittleEndian.PutUint64(shb[16:], ^uint64(0))
+	binary.LittleEndian.PutUint32(shb[24:], uint32(len(shb)))
+
+	idb := make([]byte, 20)
+	binary.LittleEndian.PutUint32(idb[0:], pcapInterface)
+	binary.LittleEndian.PutUint32(idb[4:], uint32(len(idb)))
+	binary.LittleEndian.PutUint16(idb[8:], pcapLinkTypeRaw)
+	binary.LittleEndian.PutUint32(idb[16:], uint32(len(idb)))
+
+	if _, err := w.Write(append(shb, idb...)); err != nil {
+		return nil, err
+	}
+	return &PcapWriter{w: w}, nil
+}
+
+// writePacket writes an IP packet with the current time.  After the first
+// error, which is logged, nothing more is written.
+func (p *PcapWriter) writePacket(packet []byte) {
+	padded := (len(packet) + 3) &^ 3
+	block := make([]byte, 28+padded+4)
+	now := time.Now().UnixNano() / int64(time.Microsecond)
+
+	binary.LittleEndian.PutUint32(block[0:], pcapEnhancedPacket)
+	binary.LittleEndian.PutUint32(block[4:], uint32(len(block)))
+	binary.LittleEndian.PutUint32(block[12:], uint32(now>>32))
+	binary.LittleEndian.PutUint32(block[16:], uint32(now))
+	binary.LittleEndian.PutUint32(block[20:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(block[24:], uint32(len(packet)))
+	copy(block[28:], packet)
+	binary.LittleEndian.PutUint32(block[len(block)-4:], uint32(len(block)))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.failed {
+		return
+	}
+	if _, err := p.w.Write(block); err != nil {
+		log.Printf("warning: could not write to pcap file, stopping capture: %s", err)
+		p.failed = true
+	}
+}
+
+// pcapStream is the synthetic TCP connection between a client and its
+// destination, keeping track of the sequence number in each direction.
+type pcapStream struct {
+	w              *PcapWriter
+	client, target *net.TCPAddr
+
+	mu             sync.Mutex
+	seqUp, seqDown uint32
+	closeOnce      sync.Once
+}
+
+// newPcapStream starts a stream by writing a TCP handshake.
+func newPcapStream(w *PcapWriter, client, target *net.TCPAddr) *pcapStream {
+	s := &pcapStream{w: w, client: client, target: target}
+	s.segment(true, tcpSYN, nil)
+	s.segment(false, tcpSYN|tcpACK, nil)
+	s.seqUp, s.seqDown = 1, 1
+	s.segment(true, tcpACK, nil)
+	return s
+}
+
+// data writes the payload sent in one direction, split into segments that
+// fit in an IP packet.
+func (s *pcapStream) data(up bool, p []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(p) > 0 {
+		n := len(p)
+		if n > pcapMaxSegmentBytes {
+			n = pcapMaxSegmentBytes
+		}
+		s.segment(up, tcpPSH|tcpACK, p[:n])
+		if up {
+			s.seqUp += uint32(n)
+		} else {
+			s.seqDown += uint32(n)
+		}
+		p = p[n:]
+	}
+}
+
+// close ends the stream with a FIN in each direction.
+func (s *pcapStream) close() {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.segment(true, tcpFIN|tcpACK, nil)
+		s.segment(false, tcpFIN|tcpACK, nil)
+	})
+}
+
+// segment writes a TCP segment from the client if up is set, and from the
+// destination otherwise.
+func (s *pcapStream) segment(up bool, flags byte, payload []byte) {
+	src, dst, seq, ack := s.client, s.target, s.seqUp, s.seqDown
+	if !up {
+		src, dst, seq, ack = s.target, s.client, s.seqDown, s.seqUp
+	}
+	if flags&tcpACK == 0 {
+		ack = 0
+	}
+
+	tcp := make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(tcp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	copy(tcp[20:], payload)
+
+	s.w.writePacket(ipPacket(src.IP, dst.IP, tcp))
+}
+
+// ipPacket wraps a TCP segment in an IPv4 header if both addresses are IPv4,
+// and in an IPv6 header otherwise, filling in the TCP checksum.
+func ipPacket(src, dst net.IP, tcp []byte) []byte {
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		pseudo := make([]byte, 12)
+		copy(pseudo[0:], src4)
+		copy(pseudo[4:], dst4)
+		pseudo[9] = 6
+		binary.BigEndian.PutUint16(pseudo[10:], uint16(len(tcp)))
+		binary.BigEndian.PutUint16(tcp[16:], checksum(pseudo, tcp))
+
+		ip := make([]byte, 20, 20+len(tcp))
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+		binary.BigEndian.PutUint16(ip[6:], 0x4000) // don't fragment
+		ip[8] = 64
+		ip[9] = 6
+		copy(ip[12:], src4)
+		copy(ip[16:], dst4)
+		binary.BigEndian.PutUint16(ip[10:], checksum(ip))
+		return append(ip, tcp...)
+	}
+
+	// Mixed families are shown as IPv4-mapped IPv6 addresses
+	src16, dst16 := src.To16(), dst.To16()
+	pseudo := make([]byte, 40)
+	copy(pseudo[0:], src16)
+	copy(pseudo[16:], dst16)
+	binary.BigEndian.PutUint32(pseudo[32:], uint32(len(tcp)))
+	pseudo[39] = 6
+	binary.BigEndian.PutUint16(tcp[16:], checksum(pseudo, tcp))
+
+	ip := make([]byte, 40, 40+len(tcp))
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:], uint16(len(tcp)))
+	ip[6] = 6
+	ip[7] = 64
+	copy(ip[8:], src16)
+	copy(ip[24:], dst16)
+	return append(ip, tcp...)
+}
+
+// checksum computes the Internet checksum of the concatenated data, each
+// part of which except the last must have an even length.
+func checksum(parts ...[]byte) uint16 {
+	var sum uint32
+	for _, b := range parts {
+		for i := 0; i+1 < len(b); i += 2 {
+			sum += uint32(b[i])<<8 | uint32(b[i+1])
+		}
+		if len(b)%2 == 1 {
+			sum += uint32(b[len(b)-1]) << 8
+		}
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// captureConn is a destination connection whose traffic is written to a
+// pcap stream: writes go up from the client, and reads come down from the
+// destination.
+type captureConn struct {
+	net.Conn
+	stream *pcapStream
+}
+
+func (c *captureConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.stream.data(false, p[:n])
+	}
+	return n, err
+}
+
+func (c *captureConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.stream.data(true, p[:n])
+	}
+	return n, err
+}
+
+func (c *captureConn) Close() error {
+	c.stream.close()
+	return c.Conn.Close()
+}
+
+// capture wraps a connection to the destination at addr so that its traffic
+// is captured, if a capture file is configured.
+func (s *Server) capture(ctx context.Context, target net.Conn, addr string) net.Conn {
+	c, ok := connFromContext(ctx)
+	if s.conf.Capture == nil || !ok {
+		return target
+	}
+	client, ok := c.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return target
+	}
+
+	// Capture the destination the client asked for, rather than the
+	// upstream proxy's address, if there is one
+	dst, ok := target.RemoteAddr().(*net.TCPAddr)
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			if p, err := parsePort(port); err == nil {
+				dst, ok = &net.TCPAddr{IP: ip, Port: p}, true
+			}
+		}
+	}
+	if !ok {
+		return target
+	}
+	return &captureConn{Conn: target, stream: newPcapStream(s.conf.Capture, client, dst)}
+}
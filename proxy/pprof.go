@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+)
+
+// ServePprof starts an HTTP server exposing the runtime profiles under
+// /debug/pprof/, and returns it so that it can be closed.  The profiles
+// reveal a lot about the process, and taking them costs CPU, so the
+// listener should only be reachable from trusted hosts.
+func ServePprof(l net.Listener) *http.Server {
+	// Register the handlers on a mux of our own, rather than importing
+	// net/http/pprof for its side effect on http.DefaultServeMux
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	// No write timeout, since CPU profiles and traces take as long as the
+	// client asks for
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	if !isLoopback(l.Addr()) {
+		log.Printf("warning: serving profiles on a non-loopback address, which anyone who can reach it can use: %s", l.Addr())
+	}
+	log.Printf("info: serving profiles on: %s", l.Addr())
+	go func() {
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Printf("error: could not serve profiles: %s", err)
+		}
+	}()
+	return srv
+}
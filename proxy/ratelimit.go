@@ -0,0 +1,17 @@
+package proxy
+
+import (
+	"math"
+
+	"golang.org/x/time/rate"
+)
+
+// newRateLimiter returns a token bucket allowing up to bytesPerSec bytes per
+// second, with bursts of up to one second's worth of bytes.
+func newRateLimiter(bytesPerSec uint64) *rate.Limiter {
+	burst := bytesPerSec
+	if burst > math.MaxInt32 {
+		burst = math.MaxInt32
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSec), int(burst))
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimitedWrite(t *testing.T) {
+	client, peer := net.Pipe()
+	defer peer.Close()
+	go io.Copy(ioutil.Discard, peer)
+
+	pc := newProxyConn(context.Background(), client, 10000)
+	defer pc.Close()
+
+	// The first second's worth goes out at once, the rest at 10000 bytes/sec
+	start := time.Now()
+	n, err := pc.Write(make([]byte, 15000))
+	elapsed := time.Since(start)
+	if n != 15000 || err != nil {
+		t.Fatalf("wrote %d bytes, error %v", n, err)
+	}
+	if elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("writing took %s, want about 500ms", elapsed)
+	}
+	if pc.bytesDown != 15000 {
+		t.Errorf("counted %d bytes, want 15000", pc.bytesDown)
+	}
+}
+
+func TestRateLimitStopped(t *testing.T) {
+	client, peer := net.Pipe()
+	defer peer.Close()
+	go io.Copy(ioutil.Discard, peer)
+
+	pc := newProxyConn(context.Background(), client, 1000)
+	defer pc.Close()
+	time.AfterFunc(100*time.Millisecond, func() { pc.stop("test") })
+
+	start := time.Now()
+	n, err := pc.Write(make([]byte, 10000))
+	if err == nil {
+		t.Fatal("write to a stopped connection succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("write returned %s after the connection was stopped", elapsed)
+	}
+	if n != 1000 {
+		t.Errorf("wrote %d bytes before stopping, want the first 1000", n)
+	}
+}
@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"net/url"
+	"strings"
+)
+
+// redacted replaces passwords in URLs that are logged.
+const redacted = "****"
+
+// RedactURL returns the URL with the password, if any, replaced by "****",
+// so that it can be logged.  It works on the raw string, so that URLs which
+// fail to parse are redacted too.
+func RedactURL(rawurl string) string {
+	scheme := strings.Index(rawurl, "://")
+	if scheme < 0 {
+		return rawurl
+	}
+	rest := rawurl[scheme+3:]
+
+	// The user info ends at the last '@' before the path
+	authority := rest
+	if i := strings.IndexAny(rest, "/?#"); i >= 0 {
+		authority = rest[:i]
+	}
+	at := strings.LastIndex(authority, "@")
+	if at < 0 {
+		return rawurl
+	}
+	colon := strings.Index(authority[:at], ":")
+	if colon < 0 {
+		return rawurl
+	}
+	return rawurl[:scheme+3] + authority[:colon+1] + redacted + rest[at:]
+}
+
+// RedactURLError redacts the URL in an error from url.Parse.
+func RedactURLError(err error) error {
+	if ue, ok := err.(*url.Error); ok {
+		return &url.Error{Op: ue.Op, URL: RedactURL(ue.URL), Err: ue.Err}
+	}
+	return err
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+)
+
+// NetResolver is a socks5.NameResolver backed by a net.Resolver.
+type NetResolver struct {
+	Resolver *net.Resolver
+}
+
+// NewServerResolver returns a resolver that sends all queries to the given
+// DNS server address (host:port).
+func NewServerResolver(server string) NetResolver {
+	return NetResolver{
+		Resolver: &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		},
+	}
+}
+
+func (r NetResolver) Resolve(name string) (net.IP, error) {
+	addrs, err := r.Resolver.LookupIPAddr(context.Background(), name)
+	if err != nil {
+		log.Printf("debug: could not resolve domain=%q error=%q", name, err)
+		return nil, err
+	}
+	return addrs[0].IP, nil
+}
+
+// NoResolver is a socks5.NameResolver that refuses to resolve anything, so
+// that clients can only connect to IP addresses.  This keeps the proxy from
+// making DNS queries on their behalf, which could carry data out.
+type NoResolver struct{}
+
+func (NoResolver) Resolve(name string) (net.IP, error) {
+	log.Printf("info: denied connection domain=%q reason=%q", name, "host names are not resolved")
+	metrics.denied(ReasonDomain)
+	return nil, fmt.Errorf("not resolving %s: only IP addresses are allowed", name)
+}
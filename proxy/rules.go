@@ -0,0 +1,445 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	flag "github.com/ogier/pflag"
+)
+
+// ruleLists holds the source, destination and port allow-lists and the
+// source and destination deny-lists in effect.
+type ruleLists struct {
+	source IPNetSlice
+	dest   IPNetSlice
+	ports  PortRangeSlice
+
+	denySource IPNetSlice
+	denyDest   IPNetSlice
+
+	// users holds the lists given for individual users, which replace the
+	// corresponding global list for that user
+	users map[string]*ruleLists
+}
+
+// forUser returns the lists that apply to the given authenticated user: any
+// list the user has its own entries for replaces the global one.
+func (l *ruleLists) forUser(user string) *ruleLists {
+	u, ok := l.users[user]
+	if !ok {
+		return l
+	}
+
+	merged := *l
+	if len(u.source) > 0 {
+		merged.source = u.source
+	}
+	if len(u.dest) > 0 {
+		merged.dest = u.dest
+	}
+	if len(u.ports) > 0 {
+		merged.ports = u.ports
+	}
+	if len(u.denySource) > 0 {
+		merged.denySource = u.denySource
+	}
+	if len(u.denyDest) > 0 {
+		merged.denyDest = u.denyDest
+	}
+	return &merged
+}
+
+// Rules decides which connections the proxy allows.  Its fields must not be
+// changed once it is in use, except through Reload.
+type Rules struct {
+	// Allowed sources, destinations and destination ports.  An empty list
+	// allows everything.
+	Source IPNetSlice
+	Dest   IPNetSlice
+	Ports  PortRangeSlice
+
+	// AllowLocalhost allows loopback sources whatever the source
+	// allow-lists say.  The other lists still apply to them.
+	AllowLocalhost bool
+
+	// Denied sources and destinations, which take precedence over the
+	// allow-lists.
+	DenySource IPNetSlice
+	DenyDest   IPNetSlice
+
+	// ACL is checked after the lists, in order, and the first rule that
+	// matches a connection decides whether it is allowed.  Connections no
+	// rule matches are allowed.
+	ACL ACLRuleSlice
+
+	// File holds more allow-list entries, in the format read by
+	// readRulesFile.  It is re-read by Reload.
+	File string
+
+	// If not empty, connections are only allowed during these windows
+	AllowHours TimeWindowSlice
+
+	// If GeoIP is set, destinations are checked against the country lists,
+	// with DenyCountries taking precedence.
+	GeoIP          *GeoIP
+	AllowCountries CountryList
+	DenyCountries  CountryList
+
+	// DenyPrivate denies connections to loopback, private and other
+	// non-public destinations.
+	DenyPrivate bool
+
+	// RequireHostName denies connections to destinations the client gives
+	// as an IP address rather than a host name, which the domain
+	// allow-list can't be checked against.
+	RequireHostName bool
+
+	// Bans, if not nil, denies connections from banned sources, and counts
+	// denials towards banning their source.
+	Bans *Bans
+
+	// DenyMode is how clients are answered when a request is denied, and
+	// TarpitDuration how long DenyTarpit holds their connections for.  The
+	// default is DenyReject.
+	DenyMode       DenyMode
+	TarpitDuration time.Duration
+
+	// Bind allows the BIND command, which has the proxy listen for an
+	// inbound connection from the destination, subject to the same checks
+	// as connections to it.  Without it, BIND is always denied.
+	Bind bool
+
+	// LogSample, if more than 1, logs only one in every LogSample allowed
+	// connections.  Denied connections are always logged.
+	LogSample uint64
+
+	// DryRun checks and logs every connection as usual, marking the lines
+	// "dry-run", but allows the ones it would deny.
+	DryRun bool
+
+	// decisions counts the connections checked, for LogSample
+	decisions uint64
+
+	// lists holds a *ruleLists combining the lists above with the file,
+	// which is swapped out as a whole when the rules are reloaded.
+	lists atomic.Value
+}
+
+// load builds the allow-lists from the rules' own lists and the rules file,
+// if any.
+func (r *Rules) load() (*ruleLists, error) {
+	lists := &ruleLists{
+		source: append(IPNetSlice(nil), r.Source...),
+		dest:   append(IPNetSlice(nil), r.Dest...),
+		ports:  append(PortRangeSlice(nil), r.Ports...),
+
+		denySource: append(IPNetSlice(nil), r.DenySource...),
+		denyDest:   append(IPNetSlice(nil), r.DenyDest...),
+	}
+
+	if r.File != "" {
+		if err := readRulesFile(r.File, lists); err != nil {
+			return nil, err
+		}
+	}
+	return lists, nil
+}
+
+// current returns the allow-lists in effect.
+func (r *Rules) current() *ruleLists {
+	if lists, ok := r.lists.Load().(*ruleLists); ok {
+		return lists
+	}
+	// Not loaded yet, so there's no file to consider
+	return &ruleLists{
+		source:     r.Source,
+		dest:       r.Dest,
+		ports:      r.Ports,
+		denySource: r.DenySource,
+		denyDest:   r.DenyDest,
+	}
+}
+
+// readRulesFile reads a rules file into the given lists.  Each line is of the
+// form "source-ips <ip or cidr>", "dest-ips <ip or cidr>",
+// "dest-ports <port or range>", "deny-source-ips <ip or cidr>" or
+// "deny-dest-ips <ip or cidr>", optionally prefixed with "user <name>" to
+// apply only to that user; blank lines and lines starting with '#' are
+// ignored.
+func readRulesFile(path string, lists *ruleLists) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		target := lists
+		if len(fields) == 4 && fields[0] == "user" {
+			if lists.users == nil {
+				lists.users = make(map[string]*ruleLists)
+			}
+			if target = lists.users[fields[1]]; target == nil {
+				target = &ruleLists{}
+				lists.users[fields[1]] = target
+			}
+			fields = fields[2:]
+		}
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: expected '[user <name>] <list> <address>'", path, lineno)
+		}
+
+		var list flag.Value
+		switch fields[0] {
+		case "source-ips":
+			list = &target.source
+		case "dest-ips":
+			list = &target.dest
+		case "dest-ports":
+			list = &target.ports
+		case "deny-source-ips":
+			list = &target.denySource
+		case "deny-dest-ips":
+			list = &target.denyDest
+		default:
+			return fmt.Errorf("%s:%d: unknown list %q", path, lineno, fields[0])
+		}
+
+		if err := list.Set(fields[1]); err != nil {
+			return fmt.Errorf("%s:%d: %s", path, lineno, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// notAllowed returns which of the lists doesn't allow a connection from srcIP
+// to dstIP:dstPort, or the empty reason if they all do.  An empty list allows
+// everything, and anySource skips the source list.
+func (l *ruleLists) notAllowed(srcIP, dstIP net.IP, dstPort int, anySource bool) DenyReason {
+	switch {
+	case !anySource && len(l.source) > 0 && !l.source.Contains(srcIP):
+		return ReasonSourceNotAllowed
+	case len(l.dest) > 0 && !l.dest.Contains(dstIP):
+		return ReasonDestNotAllowed
+	case len(l.ports) > 0 && !l.ports.Contains(dstPort):
+		return ReasonPortNotAllowed
+	}
+	return ""
+}
+
+// deniedBy returns why the deny-lists reject a connection from srcIP to
+// dstIP, or empty reasons if they don't.
+func (l *ruleLists) deniedBy(srcIP, dstIP net.IP) (DenyReason, string) {
+	if l.denySource.Contains(srcIP) {
+		return ReasonSourceDenied, "source is denied"
+	}
+	if l.denyDest.Contains(dstIP) {
+		return ReasonDestDenied, "destination is denied"
+	}
+	return "", ""
+}
+
+// Reload re-reads the rules file and swaps in the new allow-lists.  On error,
+// the previous lists stay in effect.
+func (r *Rules) Reload() error {
+	lists, err := r.load()
+	if err != nil {
+		return err
+	}
+	r.lists.Store(lists)
+
+	log.Printf("info: loaded %d source IP, %d destination IP and %d destination port rule(s), %d deny rule(s), and rules for %d user(s)",
+		len(lists.source), len(lists.dest), len(lists.ports), len(lists.denySource)+len(lists.denyDest), len(lists.users))
+	return nil
+}
+
+// Summary counts the rules in effect, for logging.
+func (r *Rules) Summary() string {
+	lists := r.current()
+	return fmt.Sprintf("source=%d dest=%d ports=%d deny=%d acl=%d users=%d",
+		len(lists.source), len(lists.dest), len(lists.ports), len(lists.denySource)+len(lists.denyDest),
+		len(r.ACL), len(lists.users))
+}
+
+func (r *Rules) AllowConnect(dstIP net.IP, dstPort int, srcIP net.IP, srcPort int) bool {
+	return r.allow("CONNECT", dstIP, dstPort, srcIP, srcPort)
+}
+
+// allow checks a request with the given command, logging the outcome and
+// recording it on the connection for the access log.
+func (r *Rules) allow(command string, dstIP net.IP, dstPort int, srcIP net.IP, srcPort int) (allowed bool) {
+	id := connID(srcIP, srcPort)
+	src, dst := hostPort(srcIP, srcPort), hostPort(dstIP, dstPort)
+	var user, host, denyReason string
+	c := lookupConn(srcIP, srcPort)
+	if c != nil {
+		user, host = c.authUser(), c.requestedHost()
+		defer func() { c.setDest(command, dst, allowed, denyReason) }()
+	}
+
+	// Show the requested host name too, so that a name resolving to an
+	// unexpected address stands out
+	target := dst
+	if host != "" {
+		target = fmt.Sprintf("%s (%s)", host, dst)
+	}
+
+	sampled := r.LogSample <= 1 || atomic.AddUint64(&r.decisions, 1)%r.LogSample == 1
+	if sampled {
+		log.Printf("debug: conn=%s checking rules command=%q src=%q dst=%q", id, command, src, target)
+	}
+
+	kind, reason := r.denied(user, srcIP, dstIP, dstPort)
+	if kind == "" && command == "CONNECT" && r.RequireHostName && host == "" {
+		kind, reason = ReasonDomain, "destination is an IP address, not an allowed domain"
+	}
+	if command == "BIND" && !r.Bind {
+		kind, reason = ReasonBind, "BIND is not enabled"
+	}
+	if r.Bans.Banned(srcIP) {
+		kind, reason = ReasonBanned, "source is banned"
+	} else if kind != "" && !r.DryRun {
+		r.Bans.Fail(srcIP, "denied connection to "+target)
+	}
+	if kind != "" && r.DryRun {
+		log.Printf("info: conn=%s dry-run: would deny connection command=%q user=%q src=%q dst=%q reason=%q",
+			id, command, user, src, target, reason)
+	} else if kind != "" {
+		denyReason = reason
+		log.Printf("info: conn=%s denied connection command=%q user=%q src=%q dst=%q reason=%q mode=%q",
+			id, command, user, src, target, reason, r.mode())
+		metrics.denied(kind)
+		events.publish(&Event{Type: "deny", Conn: id, Source: src, User: user, Command: command, Dest: target, Reason: reason})
+		if c != nil {
+			r.silence(c)
+		}
+		return false
+	}
+	if sampled && r.DryRun && kind == "" {
+		log.Printf("info: conn=%s dry-run: would allow connection command=%q user=%q src=%q dst=%q", id, command, user, src, target)
+	} else if sampled && !r.DryRun {
+		log.Printf("info: conn=%s allowed connection command=%q user=%q src=%q dst=%q", id, command, user, src, target)
+	}
+	events.publish(&Event{Type: "connect", Conn: id, Source: src, User: user, Command: command, Dest: target})
+	return true
+}
+
+// denied returns the kind of reason the connection is denied for, and the
+// reason itself, or empty reasons if it is allowed.  user is the name the
+// client authenticated with, if any.
+func (r *Rules) denied(user string, srcIP, dstIP net.IP, dstPort int) (DenyReason, string) {
+	lists := r.current().forUser(user)
+	if kind, reason := lists.deniedBy(srcIP, dstIP); kind != "" {
+		return kind, reason
+	}
+	anySource := r.AllowLocalhost && srcIP.IsLoopback()
+	if kind := lists.notAllowed(srcIP, dstIP, dstPort, anySource); kind != "" {
+		return kind, "not in allow-lists"
+	}
+	if rule, ok := r.ACL.Match("tcp", dstIP, dstPort); ok && !rule.Allow {
+		return ReasonRule, fmt.Sprintf("denied by rule %q", rule)
+	}
+
+	if len(r.AllowHours) > 0 && !r.AllowHours.Contains(time.Now()) {
+		return ReasonHours, "outside allowed hours"
+	}
+
+	if r.GeoIP != nil {
+		if reason := r.countryDenied(dstIP); reason != "" {
+			return ReasonCountry, reason
+		}
+	}
+
+	if r.DenyPrivate {
+		if category := privateCategory(dstIP); category != "" {
+			return ReasonPrivate, "destination is " + category
+		}
+	}
+	return "", ""
+}
+
+// countryDenied returns why connections to the IP are denied by the country
+// lists, or the empty string if they are allowed.
+func (r *Rules) countryDenied(ip net.IP) string {
+	country, err := r.GeoIP.Country(ip)
+	if err != nil {
+		log.Printf("warning: could not look up country of %s: %s", ip, err)
+	}
+
+	switch {
+	case country != "" && r.DenyCountries.Contains(country):
+		return "destination country " + country + " is denied"
+	case len(r.AllowCountries) > 0 && country == "":
+		return "destination country is unknown"
+	case len(r.AllowCountries) > 0 && !r.AllowCountries.Contains(country):
+		return "destination country " + country + " is not allowed"
+	}
+	return ""
+}
+
+// privateRanges are the destination ranges blocked by --deny-private, with
+// the category reported when a connection is denied.
+var privateRanges = []struct {
+	category string
+	network  *net.IPNet
+}{
+	{"cloud metadata", mustParseCIDR("169.254.169.254/32")},
+	{"loopback", mustParseCIDR("127.0.0.0/8")},
+	{"loopback", mustParseCIDR("::1/128")},
+	{"private (RFC 1918)", mustParseCIDR("10.0.0.0/8")},
+	{"private (RFC 1918)", mustParseCIDR("172.16.0.0/12")},
+	{"private (RFC 1918)", mustParseCIDR("192.168.0.0/16")},
+	{"private (unique local)", mustParseCIDR("fc00::/7")},
+	{"link-local", mustParseCIDR("169.254.0.0/16")},
+	{"link-local", mustParseCIDR("fe80::/10")},
+	{"unspecified", mustParseCIDR("0.0.0.0/8")},
+	{"unspecified", mustParseCIDR("::/128")},
+}
+
+// privateCategory returns the kind of non-public address the IP is, or the
+// empty string if it is a public address.
+func privateCategory(ip net.IP) string {
+	for _, r := range privateRanges {
+		if r.network.Contains(ip) {
+			return r.category
+		}
+	}
+	return ""
+}
+
+// hostPort formats an IP and port as an address.
+func hostPort(ip net.IP, port int) string {
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port))
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// AllowBind allows a BIND request if Bind is set and the expected peer,
+// dstIP:dstPort, passes the same checks as a connection to it would.
+func (r *Rules) AllowBind(dstIP net.IP, dstPort int, srcIP net.IP, srcPort int) bool {
+	return r.allow("BIND", dstIP, dstPort, srcIP, srcPort)
+}
+
+func (r *Rules) AllowAssociate(dstIP net.IP, dstPort int, srcIP net.IP, srcPort int) bool {
+	return false
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+// newRuleLists builds allow-lists from flag values, failing the test on an
+// invalid one.
+func newRuleLists(t *testing.T, source, dest, ports []string) *ruleLists {
+	t.Helper()
+	l := &ruleLists{}
+	for _, v := range source {
+		if err := l.source.Set(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, v := range dest {
+		if err := l.dest.Set(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, v := range ports {
+		if err := l.ports.Set(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return l
+}
+
+func TestNotAllowed(t *testing.T) {
+	tests := []struct {
+		name      string
+		source    []string
+		dest      []string
+		ports     []string
+		src, dst  string
+		port      int
+		anySource bool
+		want      DenyReason
+	}{
+		{name: "empty lists", src: "192.0.2.1", dst: "198.51.100.1", port: 443},
+
+		{name: "source only, allowed", source: []string{"192.0.2.0/24"},
+			src: "192.0.2.1", dst: "198.51.100.1", port: 443},
+		{name: "source only, denied", source: []string{"192.0.2.0/24"},
+			src: "203.0.113.1", dst: "198.51.100.1", port: 443, want: ReasonSourceNotAllowed},
+		{name: "source only, any source", source: []string{"192.0.2.0/24"},
+			src: "127.0.0.1", dst: "198.51.100.1", port: 443, anySource: true},
+
+		{name: "dest only, allowed", dest: []string{"198.51.100.0/24"},
+			src: "203.0.113.1", dst: "198.51.100.1", port: 443},
+		{name: "dest only, denied", dest: []string{"198.51.100.0/24"},
+			src: "203.0.113.1", dst: "203.0.113.2", port: 443, want: ReasonDestNotAllowed},
+
+		{name: "both, allowed", source: []string{"192.0.2.0/24"}, dest: []string{"198.51.100.1"},
+			src: "192.0.2.1", dst: "198.51.100.1", port: 443},
+		{name: "both, source denied first", source: []string{"192.0.2.0/24"}, dest: []string{"198.51.100.1"},
+			src: "203.0.113.1", dst: "203.0.113.2", port: 443, want: ReasonSourceNotAllowed},
+		{name: "both, dest denied", source: []string{"192.0.2.0/24"}, dest: []string{"198.51.100.1"},
+			src: "192.0.2.1", dst: "198.51.100.2", port: 443, want: ReasonDestNotAllowed},
+
+		{name: "neither, port allowed", ports: []string{"80", "443"},
+			src: "203.0.113.1", dst: "203.0.113.2", port: 443},
+		{name: "neither, port denied", ports: []string{"80", "443"},
+			src: "203.0.113.1", dst: "203.0.113.2", port: 22, want: ReasonPortNotAllowed},
+		{name: "port range", ports: []string{"8000-8080"},
+			src: "203.0.113.1", dst: "203.0.113.2", port: 8080},
+		{name: "all allowed but port", source: []string{"192.0.2.0/24"}, dest: []string{"198.51.100.1"}, ports: []string{"443"},
+			src: "192.0.2.1", dst: "198.51.100.1", port: 80, want: ReasonPortNotAllowed},
+
+		{name: "IPv6 source allowed", source: []string{"2001:db8::/32"},
+			src: "2001:db8::1", dst: "198.51.100.1", port: 443},
+		{name: "IPv6 source denied", source: []string{"2001:db8::/32"},
+			src: "2001:db9::1", dst: "198.51.100.1", port: 443, want: ReasonSourceNotAllowed},
+		{name: "IPv6 dest allowed", dest: []string{"2001:db8::1"},
+			src: "192.0.2.1", dst: "2001:db8::1", port: 443},
+		{name: "IPv6 dest denied", dest: []string{"2001:db8::1"},
+			src: "192.0.2.1", dst: "2001:db8::2", port: 443, want: ReasonDestNotAllowed},
+		{name: "IPv4 list, IPv6 dest", dest: []string{"0.0.0.0/0"},
+			src: "192.0.2.1", dst: "2001:db8::1", port: 443, want: ReasonDestNotAllowed},
+	}
+
+	for _, tt := range tests {
+		l := newRuleLists(t, tt.source, tt.dest, tt.ports)
+		got := l.notAllowed(net.ParseIP(tt.src), net.ParseIP(tt.dst), tt.port, tt.anySource)
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRequireHostName(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 61002}
+	client, _ := net.Pipe()
+	c := newProxyConn(context.Background(), &tcpClientConn{Conn: client, remote: src}, 0)
+	c.register()
+	defer c.unregister()
+	dst := net.ParseIP("198.51.100.1")
+
+	tests := []struct {
+		name    string
+		require bool
+		host    string
+		command string
+		want    bool
+	}{
+		{name: "IP address, not required", command: "CONNECT", want: true},
+		{name: "IP address, required", require: true, command: "CONNECT", want: false},
+		{name: "host name, required", require: true, host: "example.com", command: "CONNECT", want: true},
+		{name: "IP address, required, BIND", require: true, command: "BIND", want: true},
+	}
+
+	for _, tt := range tests {
+		c.setHost(tt.host)
+		r := &Rules{RequireHostName: tt.require, Bind: true}
+		if got := r.allow(tt.command, dst, 443, src.IP, src.Port); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
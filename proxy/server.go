@@ -0,0 +1,636 @@
+// Package proxy implements the SOCKS proxy server behind the socks command,
+// so that it can be embedded in other programs with their own rules and
+// authentication.
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-socks5"
+)
+
+// Config configures a Server.  The zero value is a usable configuration:
+// an open proxy speaking only SOCKS5.
+type Config struct {
+	// Rules decides which connections are allowed.  If nil, all are.
+	Rules socks5.RuleSet
+
+	// AuthMethods are the authentication methods offered to SOCKS5 clients.
+	// If empty, clients don't need to authenticate.  SOCKS4 clients are
+	// rejected if any method other than no-auth is given, and HTTP CONNECT
+	// clients are checked against the socks5.UserPassAuthenticator, if any.
+	AuthMethods []socks5.Authenticator
+
+	// Resolver resolves destination host names.  If nil, the system
+	// resolver is used.
+	Resolver socks5.NameResolver
+
+	// Logger receives the SOCKS5 server's own log lines.  If nil, they go
+	// to standard error.
+	Logger *log.Logger
+
+	// SOCKS4 also accepts SOCKS4 and SOCKS4a clients, and HTTPConnect also
+	// accepts HTTP CONNECT requests, on the same listeners.
+	SOCKS4      bool
+	HTTPConnect bool
+
+	// Limits on the number of connections open at once, in total and from a
+	// single source IP.  Zero means unlimited.
+	MaxConnections          int
+	MaxConnectionsPerSource int
+
+	// MaxConcurrent limits the number of connections served at once.
+	// Connections over the limit wait up to QueueTimeout for another to
+	// finish, and are closed if none does.  Zero means unlimited.
+	MaxConcurrent int
+	QueueTimeout  time.Duration
+
+	// MaxConnectionAge closes connections once they have been open this
+	// long, however active they are.  Zero means unlimited.
+	MaxConnectionAge time.Duration
+
+	// IdleTimeout closes connections that have relayed no data in either
+	// direction for this long.  Zero means no timeout.
+	IdleTimeout time.Duration
+
+	// HandshakeTimeout closes connections whose client hasn't got as far
+	// as making its request, through any authentication, this long after
+	// the proxy started serving it.  Zero means no timeout.
+	HandshakeTimeout time.Duration
+
+	// RateLimit limits each connection to this many bytes per second in
+	// each direction.  Zero means unlimited.
+	RateLimit uint64
+
+	// DialTimeout bounds how long connecting to a destination may take.
+	// Zero means no timeout.
+	DialTimeout time.Duration
+
+	// DialRetries is how many more times to try connecting to a
+	// destination that refused the connection or didn't answer in time,
+	// backing off between attempts.
+	DialRetries int
+
+	// DialParallel races connections to all the addresses of a destination
+	// host name, IPv6 and IPv4 alike, instead of only dialing the first, so
+	// that a broken path to one of them doesn't stall the connection.
+	DialParallel bool
+
+	// LocalAddr is the local address to make outbound connections from, and
+	// to listen on for BIND requests.  If nil, the operating system picks
+	// one, and BIND listens on the address the client connected to.
+	LocalAddr *net.TCPAddr
+
+	// Upstream is the proxies to make outbound connections through.  If
+	// nil, destinations are connected to directly.
+	Upstream *UpstreamPool
+
+	// Dial, if not nil, connects to destinations in place of the operating
+	// system, for instance through an SSH connection.  It isn't used for
+	// connecting to Upstream proxies, and LocalAddr doesn't apply to it.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// TCPKeepAlive is the keep-alive period for client and destination
+	// connections.  Zero uses Go's default, and a negative value disables
+	// keep-alives.
+	TCPKeepAlive time.Duration
+
+	// TCPDelay enables Nagle's algorithm on client and destination
+	// connections, which Go disables by default.
+	TCPDelay bool
+
+	// AccessLog receives a line for each completed connection.  If nil, no
+	// access log is written.
+	AccessLog io.Writer
+
+	// SNIFilter, if not nil, checks the server name in the TLS ClientHello
+	// that clients start connections to a destination with against its
+	// domain lists, closing the connection if it is denied.  Nothing is
+	// relayed to the destination until the ClientHello has been checked.
+	SNIFilter *DomainResolver
+
+	// Tracer, if not nil, exports a span for each connection once it has
+	// closed.
+	Tracer *Tracer
+
+	// Capture, if not nil, receives the data relayed to and from each
+	// destination, as synthetic TCP packets.
+	Capture *PcapWriter
+
+	// TLSConfig, if not nil, has clients speak TLS to the server, with the
+	// SOCKS or HTTP protocol inside.
+	TLSConfig *tls.Config
+
+	// CopyBufferSize is the size of the buffers used to relay data between
+	// clients and destinations.  Zero uses io.Copy's default of 32KB.
+	CopyBufferSize int
+
+	// Accounting, if not nil, totals the bytes relayed for each source IP
+	// and user.  It is also exported on the metrics endpoint.
+	Accounting *Accounting
+
+	// ProxyProtocol expects every connection to start with a PROXY protocol
+	// header from a load balancer, and takes the client address from it.
+	// Connections without a valid header are closed.
+	ProxyProtocol bool
+
+	// Bans, if not nil, closes connections from banned sources as soon as
+	// they are accepted, and counts failed authentication towards banning
+	// their source.  Give the same Bans to the Rules to have them count
+	// denials too.
+	Bans *Bans
+}
+
+// Server accepts connections from a listener and hands them off to the SOCKS
+// server, keeping track of them so that they can be drained on shutdown.
+type Server struct {
+	conf *Config
+
+	// config is the SOCKS5 server configuration derived from conf, with
+	// the defaults filled in
+	config *socks5.Config
+
+	// buffers supplies the copy buffers, or is nil for io.Copy's own
+	buffers *bufferPool
+
+	// slots holds a value for each connection being served, if
+	// MaxConcurrent is set
+	slots chan struct{}
+
+	// ctx is the parent of every connection's context, and is cancelled
+	// to stop them when the server gives up waiting for them on shutdown
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu        sync.Mutex
+	wg        sync.WaitGroup
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	sources   map[string]int
+	closing   bool
+}
+
+// New creates a server with the given configuration, which must not be
+// changed afterwards.
+func New(conf *Config) (*Server, error) {
+	s := &Server{
+		conf:      conf,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+		sources:   make(map[string]int),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	s.config = &socks5.Config{
+		AuthMethods: conf.AuthMethods,
+		Resolver:    conf.Resolver,
+		Rules:       conf.Rules,
+		Logger:      conf.Logger,
+		Dial:        s.dial,
+		Listen:      s.listen,
+	}
+	if conf.LocalAddr != nil {
+		s.config.BindIP = conf.LocalAddr.IP
+	}
+	if conf.CopyBufferSize > 0 {
+		s.buffers = newBufferPool(conf.CopyBufferSize)
+		s.config.BufferPool = s.buffers
+	}
+	if s.config.Logger == nil {
+		s.config.Logger = log.New(stderr, "", log.LstdFlags)
+	}
+	if conf.Accounting != nil {
+		metrics.setAccounting(conf.Accounting)
+	}
+	if conf.MaxConcurrent > 0 {
+		s.slots = make(chan struct{}, conf.MaxConcurrent)
+	}
+
+	// Creating a server fills in the defaults in the config, which is then
+	// used to create a server for each connection.
+	if _, err := socks5.New(s.config); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Run creates a server and serves it on the given address until it fails.
+func Run(conf *Config, addr string) error {
+	s, err := New(conf)
+	if err != nil {
+		return err
+	}
+	return s.ListenAndServe(addr)
+}
+
+// ListenAndServe listens on the TCP address and serves connections from it.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on the listener until it is closed.  It returns
+// nil if the listener was closed by Shutdown.  Temporary accept errors, such
+// as running out of file descriptors, are retried with exponential backoff.
+// Serve may be called concurrently with several listeners.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		l.Close()
+		return nil
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closing := s.closing
+			s.mu.Unlock()
+
+			if closing {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = minAcceptDelay
+				} else if delay *= 2; delay > maxAcceptDelay {
+					delay = maxAcceptDelay
+				}
+				log.Printf("warning: accept error, retrying in %s: %s", delay, err)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+
+		if s.conf.ProxyProtocol {
+			go s.acceptProxyProtocol(conn)
+		} else {
+			s.accept(conn)
+		}
+	}
+}
+
+// accept starts serving a new connection, unless that would exceed the
+// connection limits.
+func (s *Server) accept(conn net.Conn) {
+	if _, ok := conn.RemoteAddr().(*net.UnixAddr); ok {
+		conn = newUnixConn(conn)
+	}
+
+	metrics.ConnectionsAccepted.Inc()
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && s.conf.Bans.Banned(addr.IP) {
+		log.Printf("debug: rejected connection src=%q reason=%q", conn.RemoteAddr(), "source is banned")
+		conn.Close()
+		return
+	}
+	if err := s.track(conn); err != nil {
+		if err != errServerClosing {
+			log.Printf("warning: rejected connection src=%q reason=%q", conn.RemoteAddr(), err)
+		}
+		conn.Close()
+		return
+	}
+	go s.serveConn(conn)
+}
+
+// Closing returns whether the server has been shut down.
+func (s *Server) Closing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
+}
+
+// Bounds of the backoff between retries of temporary accept errors
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+// Serving returns whether the server is currently accepting connections on
+// any listener.
+func (s *Server) Serving() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.closing && len(s.listeners) > 0
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.untrack(conn)
+	s.setTCPOptions(conn)
+
+	if !s.acquireSlot(conn) {
+		conn.Close()
+		return
+	}
+	defer s.releaseSlot()
+
+	if s.conf.TLSConfig != nil {
+		tc, err := s.handshakeTLS(conn)
+		if err != nil {
+			log.Printf("debug: TLS handshake failed src=%q error=%q", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		conn = tc
+	}
+
+	pc := newProxyConn(s.ctx, conn, s.conf.RateLimit)
+	pc.accounting = s.conf.Accounting
+	pc.bans = s.conf.Bans
+	pc.register()
+	defer pc.unregister()
+	log.Printf("debug: conn=%s connection opened src=%q", pc.id, conn.RemoteAddr())
+
+	// A client certificate identifies the client for the rules and logs,
+	// until it authenticates as someone else
+	if name := clientCertName(conn); name != "" {
+		pc.setUser(name)
+		log.Printf("debug: conn=%s identified by TLS client certificate user=%q", pc.id, name)
+	}
+
+	start := pc.start
+	metrics.opened()
+	defer func() {
+		duration := time.Since(start)
+		metrics.closed()
+		metrics.ConnectionDuration.Observe(duration.Seconds())
+
+		log.Printf("debug: conn=%s connection closed src=%q bytes_up=%d bytes_down=%d duration=%q",
+			pc.id, conn.RemoteAddr(), atomic.LoadUint64(&pc.bytesUp), atomic.LoadUint64(&pc.bytesDown), duration)
+		writeAccessLog(s.conf.AccessLog, pc, start, duration)
+		s.conf.Tracer.record(pc, start.Add(duration))
+
+		if events.active() {
+			e := pc.event("close")
+			e.Duration = duration.Seconds()
+			events.publish(&e)
+		}
+	}()
+
+	// Stopping the connection closes it, which ends the relay however far
+	// it has got.  Once it has finished, stop it anyway to clean up.
+	watched := make(chan struct{})
+	go func() {
+		s.watch(pc)
+		close(watched)
+	}()
+	defer func() {
+		pc.stop("")
+		<-watched
+	}()
+
+	socks := s.connServer(pc)
+	if !s.conf.SOCKS4 && !s.conf.HTTPConnect {
+		metrics.ConnectionsServed.WithLabelValues("socks5").Inc()
+		socks.ServeConn(pc.protected(pc))
+		return
+	}
+
+	// Peek at the first byte to dispatch SOCKS4 and HTTP requests to our own
+	// handlers, since the SOCKS5 server only speaks version 5.
+	r := bufio.NewReader(pc)
+	version, err := r.Peek(1)
+	if err != nil {
+		pc.Close()
+		return
+	}
+
+	switch {
+	case s.conf.SOCKS4 && version[0] == socks4Version:
+		metrics.ConnectionsServed.WithLabelValues("socks4").Inc()
+		defer pc.Close()
+		if err := s.serveSOCKS4(pc, r); err != nil {
+			log.Printf("debug: conn=%s socks4: %s", pc.id, err)
+		}
+	case s.conf.HTTPConnect && version[0] == 'C':
+		metrics.ConnectionsServed.WithLabelValues("http").Inc()
+		defer pc.Close()
+		if err := s.serveHTTPConnect(pc, r); err != nil {
+			log.Printf("debug: conn=%s http: %s", pc.id, err)
+		}
+	default:
+		metrics.ConnectionsServed.WithLabelValues("socks5").Inc()
+		socks.ServeConn(pc.protected(&bufferedConn{Conn: pc, r: r}))
+	}
+}
+
+// connServer returns a SOCKS5 server for a single connection, whose dialer,
+// listener, resolver and logger know which connection they are working for.
+func (s *Server) connServer(pc *proxyConn) *socks5.Server {
+	conf := *s.config
+	conf.Logger = log.New(&connLogWriter{id: pc.id, w: s.config.Logger.Writer()}, "", 0)
+	// The SOCKS5 server only ever passes context.Background(), so use the
+	// connection's context instead
+	conf.Dial = func(_ context.Context, network, addr string) (net.Conn, error) {
+		return s.config.Dial(withConn(pc), network, addr)
+	}
+	conf.Listen = func(_ context.Context, network, addr string) (net.Listener, error) {
+		return s.config.Listen(withConn(pc), network, addr)
+	}
+	conf.Resolver = connResolver{s.config.Resolver, pc, s.conf.DialParallel}
+
+	// Have authentication record who the client is, for the rules and logs,
+	// and GSS-API protect the connection's messages
+	conf.AuthMethods = make([]socks5.Authenticator, len(s.config.AuthMethods))
+	for i, a := range s.config.AuthMethods {
+		switch auth := a.(type) {
+		case socks5.UserPassAuthenticator:
+			a = socks5.UserPassAuthenticator{Credentials: connCredentials{auth.Credentials, pc}}
+		case GSSAPIAuthenticator:
+			pc.gss = &gssConn{}
+			a = GSSAPIAuthenticator{GSSAPI: auth.GSSAPI, pc: pc, protect: pc.gss}
+		}
+		conf.AuthMethods[i] = a
+	}
+
+	// This can't fail, since the config was already validated by New
+	server, _ := socks5.New(&conf)
+	return server
+}
+
+// requireAuth returns whether clients must authenticate before using the
+// proxy.
+func (s *Server) requireAuth() bool {
+	for _, a := range s.config.AuthMethods {
+		if a.GetCode() != (socks5.NoAuthAuthenticator{}).GetCode() {
+			return true
+		}
+	}
+	return false
+}
+
+// credentials returns the store used to check usernames and passwords, or nil
+// if clients don't need to authenticate.
+func (s *Server) credentials() socks5.CredentialStore {
+	for _, a := range s.config.AuthMethods {
+		if up, ok := a.(socks5.UserPassAuthenticator); ok {
+			return up.Credentials
+		}
+	}
+	return nil
+}
+
+// acquireSlot waits for one of the MaxConcurrent slots to serve a connection
+// in, for up to QueueTimeout.  It returns false if none came free in time.
+func (s *Server) acquireSlot(conn net.Conn) bool {
+	if s.slots == nil {
+		return true
+	}
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	metrics.ConnectionsQueued.Inc()
+	defer metrics.ConnectionsQueued.Dec()
+	log.Printf("debug: queueing connection src=%q", conn.RemoteAddr())
+
+	timer := time.NewTimer(s.conf.QueueTimeout)
+	defer timer.Stop()
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		log.Printf("warning: rejected connection src=%q reason=%q", conn.RemoteAddr(),
+			fmt.Sprintf("waited %s for one of %d connection slots", s.conf.QueueTimeout, s.conf.MaxConcurrent))
+		return false
+	}
+}
+
+func (s *Server) releaseSlot() {
+	if s.slots != nil {
+		<-s.slots
+	}
+}
+
+var errServerClosing = errors.New("server is shutting down")
+
+// stoppedConnTimeout is how long Shutdown waits for connections it has
+// stopped to finish closing.
+const stoppedConnTimeout = time.Second
+
+// track registers a new connection, enforcing the connection limits.
+func (s *Server) track(conn net.Conn) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closing {
+		return errServerClosing
+	}
+
+	source := sourceIP(conn)
+	if max := s.conf.MaxConnections; max > 0 && len(s.conns) >= max {
+		return fmt.Errorf("reached maximum of %d connections", max)
+	}
+	if max := s.conf.MaxConnectionsPerSource; max > 0 && s.sources[source] >= max {
+		return fmt.Errorf("reached maximum of %d connections for source", max)
+	}
+
+	s.conns[conn] = struct{}{}
+	s.sources[source]++
+	s.wg.Add(1)
+	return nil
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	source := sourceIP(conn)
+	if s.sources[source]--; s.sources[source] <= 0 {
+		delete(s.sources, source)
+	}
+	s.mu.Unlock()
+
+	s.wg.Done()
+}
+
+// Shutdown stops accepting new connections and waits up to the given timeout
+// for active connections to finish, after which they are closed forcibly.
+// It then logs a summary of the traffic relayed since the process started.
+func (s *Server) Shutdown(timeout time.Duration) error {
+	defer func() {
+		log.Printf("info: served %d connection(s) bytes_up=%d bytes_down=%d peak_connections=%d",
+			metrics.served(), counterValue(metrics.BytesUp), counterValue(metrics.BytesDown),
+			metrics.Peak())
+	}()
+
+	s.mu.Lock()
+	s.closing = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	active := len(s.conns)
+	s.mu.Unlock()
+
+	if active > 0 {
+		log.Printf("info: waiting for %d active connection(s) to finish", active)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+	}
+
+	// Stop the connections being served, and close the ones that haven't
+	// got that far
+	s.cancel()
+	s.mu.Lock()
+	remaining := len(s.conns)
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	// Give them a moment to finish closing and log why
+	select {
+	case <-done:
+	case <-time.After(stoppedConnTimeout):
+	}
+
+	return fmt.Errorf("closed %d connection(s) still active after %s", remaining, timeout)
+}
+
+// sourceIP returns the IP address of the remote end of the connection.
+func sourceIP(conn net.Conn) string {
+	if _, ok := conn.(*unixConn); ok {
+		return unixSource
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
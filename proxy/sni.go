@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+)
+
+// TLS record and handshake constants needed to find the server name in a
+// ClientHello, from RFC 8446 and RFC 6066
+const (
+	tlsRecordHandshake   = 22
+	tlsRecordHeaderLen   = 5
+	tlsMaxRecordLen      = 16384 + 2048
+	tlsClientHello       = 1
+	tlsExtServerName     = 0
+	tlsServerNameHost    = 0
+	maxClientHelloLength = 64 << 10
+)
+
+var (
+	// errShortClientHello means more of the connection is needed to parse
+	// the ClientHello.
+	errShortClientHello = errors.New("incomplete TLS ClientHello")
+
+	// errNotTLS means the connection doesn't start with a TLS handshake.
+	errNotTLS = errors.New("not a TLS handshake")
+)
+
+// sniConn is a connection to a destination that holds back what the client
+// sends until it has the whole TLS ClientHello, if the client starts with
+// one, and checks the server name in it against the domain lists.  Anything
+// other than TLS is relayed as it is.
+type sniConn struct {
+	net.Conn
+	client *proxyConn
+	filter *DomainResolver
+
+	// buf holds what the client sent before the check, and checked is set
+	// once it has been made
+	buf     []byte
+	checked bool
+}
+
+func (c *sniConn) Write(p []byte) (int, error) {
+	if c.checked {
+		return c.Conn.Write(p)
+	}
+
+	c.buf = append(c.buf, p...)
+	name, err := parseClientHello(c.buf)
+	switch {
+	case err == errShortClientHello:
+		// Wait for the rest, which the client sends without waiting for a
+		// reply
+		return len(p), nil
+	case err == errNotTLS:
+		log.Printf("trace: conn=%s not a TLS connection, not checking SNI", c.client.id)
+	case err != nil:
+		return 0, c.deny(name, fmt.Sprintf("invalid TLS ClientHello: %s", err))
+	case name == "":
+		log.Printf("debug: conn=%s TLS ClientHello has no server name, not checking SNI", c.client.id)
+	default:
+		_, reason := c.filter.denied(name)
+		if reason != "" && c.filter.DryRun {
+			log.Printf("info: conn=%s dry-run: would deny TLS connection sni=%q dst=%q reason=%q", c.client.id, name, c.RemoteAddr(), reason)
+			break
+		}
+		if reason != "" {
+			return 0, c.deny(name, reason)
+		}
+		log.Printf("debug: conn=%s TLS server name allowed sni=%q", c.client.id, name)
+	}
+
+	c.checked = true
+	buf := c.buf
+	c.buf = nil
+	if _, err := c.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// deny logs the denied server name and stops the connection, closing both
+// the client and the destination.
+func (c *sniConn) deny(name, reason string) error {
+	log.Printf("info: conn=%s denied TLS connection sni=%q dst=%q reason=%q", c.client.id, name, c.RemoteAddr(), reason)
+	metrics.denied(ReasonSNI)
+	c.client.stop("TLS server name denied")
+	c.Conn.Close()
+	return fmt.Errorf("TLS server name %q is denied", name)
+}
+
+// parseClientHello returns the host name in the server_name extension of
+// the TLS ClientHello at the start of data, or the empty string if it has
+// none.  The ClientHello may span several records.
+func parseClientHello(data []byte) (string, error) {
+	if len(data) > 0 && data[0] != tlsRecordHandshake {
+		return "", errNotTLS
+	}
+
+	// Gather the handshake message from the records it is split into
+	var msg []byte
+	for {
+		if len(data) < tlsRecordHeaderLen {
+			return "", errShortClientHello
+		}
+		if data[0] != tlsRecordHandshake {
+			return "", errors.New("ClientHello is interrupted by another record")
+		}
+		if data[1] != 3 {
+			if len(msg) == 0 {
+				return "", errNotTLS
+			}
+			return "", fmt.Errorf("unsupported record version %d.%d", data[1], data[2])
+		}
+		length := int(binary.BigEndian.Uint16(data[3:5]))
+		if length == 0 || length > tlsMaxRecordLen {
+			return "", fmt.Errorf("invalid record length %d", length)
+		}
+		if len(data) < tlsRecordHeaderLen+length {
+			return "", errShortClientHello
+		}
+		msg = append(msg, data[tlsRecordHeaderLen:tlsRecordHeaderLen+length]...)
+		data = data[tlsRecordHeaderLen+length:]
+
+		if len(msg) < 4 {
+			continue
+		}
+		if msg[0] != tlsClientHello {
+			return "", fmt.Errorf("handshake starts with message type %d, not ClientHello", msg[0])
+		}
+		length = int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+		if length > maxClientHelloLength {
+			return "", fmt.Errorf("ClientHello of %d bytes is too long", length)
+		}
+		if len(msg) >= 4+length {
+			return serverName(msg[4 : 4+length])
+		}
+	}
+}
+
+// serverName finds the host name in the body of a ClientHello.
+func serverName(hello []byte) (string, error) {
+	r := helloReader(hello)
+
+	// Skip the version, random, session ID, cipher suites and compression
+	// methods to get to the extensions
+	if !r.skip(2+32) || !r.skipVector(1) || !r.skipVector(2) || !r.skipVector(1) {
+		return "", errors.New("truncated ClientHello")
+	}
+	if len(r) == 0 {
+		return "", nil
+	}
+	exts, ok := r.vector(2)
+	if !ok {
+		return "", errors.New("truncated ClientHello extensions")
+	}
+
+	for len(exts) > 0 {
+		var typ uint16
+		var ext helloReader
+		if !exts.uint16(&typ) {
+			return "", errors.New("truncated ClientHello extension")
+		}
+		if ext, ok = exts.vector(2); !ok {
+			return "", errors.New("truncated ClientHello extension")
+		}
+		if typ != tlsExtServerName {
+			continue
+		}
+
+		names, ok := ext.vector(2)
+		if !ok {
+			return "", errors.New("truncated server_name extension")
+		}
+		for len(names) > 0 {
+			var nameType uint8
+			if !names.uint8(&nameType) {
+				return "", errors.New("truncated server_name extension")
+			}
+			name, ok := names.vector(2)
+			if !ok {
+				return "", errors.New("truncated server_name extension")
+			}
+			if nameType == tlsServerNameHost {
+				return string(name), nil
+			}
+		}
+		return "", nil
+	}
+	return "", nil
+}
+
+// helloReader reads the fields of a ClientHello in turn.
+type helloReader []byte
+
+func (r *helloReader) skip(n int) bool {
+	if len(*r) < n {
+		return false
+	}
+	*r = (*r)[n:]
+	return true
+}
+
+func (r *helloReader) uint8(v *uint8) bool {
+	if len(*r) < 1 {
+		return false
+	}
+	*v = (*r)[0]
+	*r = (*r)[1:]
+	return true
+}
+
+func (r *helloReader) uint16(v *uint16) bool {
+	if len(*r) < 2 {
+		return false
+	}
+	*v = binary.BigEndian.Uint16(*r)
+	*r = (*r)[2:]
+	return true
+}
+
+// vector reads a field prefixed with its length, in lenBytes bytes.
+func (r *helloReader) vector(lenBytes int) (helloReader, bool) {
+	if len(*r) < lenBytes {
+		return nil, false
+	}
+	n := 0
+	for _, b := range (*r)[:lenBytes] {
+		n = n<<8 | int(b)
+	}
+	*r = (*r)[lenBytes:]
+	if len(*r) < n {
+		return nil, false
+	}
+	v := (*r)[:n]
+	*r = (*r)[n:]
+	return v, true
+}
+
+func (r *helloReader) skipVector(lenBytes int) bool {
+	_, ok := r.vector(lenBytes)
+	return ok
+}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	socks4Version = uint8(4)
+
+	socks4Connect = uint8(1)
+
+	socks4Granted  = uint8(90)
+	socks4Rejected = uint8(91)
+)
+
+// serveSOCKS4 handles a SOCKS4 or SOCKS4a request.  Only the CONNECT command
+// is supported.  The version byte has already been peeked, but not consumed,
+// from r.
+func (s *Server) serveSOCKS4(conn *proxyConn, r *bufio.Reader) error {
+	// VN, CD, DSTPORT, DSTIP
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return fmt.Errorf("failed to read SOCKS4 request: %s", err)
+	}
+	command := header[1]
+	port := int(binary.BigEndian.Uint16(header[2:4]))
+	ip := net.IP(header[4:8])
+
+	if _, err := readNullString(r); err != nil {
+		return fmt.Errorf("failed to read SOCKS4 user ID: %s", err)
+	}
+
+	// SOCKS4a: an IP of 0.0.0.x (x != 0) means a hostname follows
+	var host string
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		name, err := readNullString(r)
+		if err != nil {
+			return fmt.Errorf("failed to read SOCKS4a hostname: %s", err)
+		}
+		host = name
+	}
+
+	if s.requireAuth() {
+		socks4Reply(conn, socks4Rejected, nil, 0)
+		return fmt.Errorf("SOCKS4 request rejected, authentication is required")
+	}
+	if command != socks4Connect {
+		socks4Reply(conn, socks4Rejected, nil, 0)
+		return fmt.Errorf("unsupported SOCKS4 command: %d", command)
+	}
+
+	if host != "" {
+		resolved, err := connResolver{s.config.Resolver, conn, s.conf.DialParallel}.Resolve(host)
+		if err != nil {
+			socks4Reply(conn, socks4Rejected, nil, 0)
+			return fmt.Errorf("failed to resolve destination '%s': %s", host, err)
+		}
+		ip = resolved
+	}
+
+	client := conn.RemoteAddr().(*net.TCPAddr)
+	if !s.config.Rules.AllowConnect(ip, port, client.IP, client.Port) {
+		socks4Reply(conn, socks4Rejected, nil, 0)
+		return fmt.Errorf("connect to %s blocked by rules", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+	}
+
+	target, err := s.config.Dial(withConn(conn), "tcp", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+	if err != nil {
+		socks4Reply(conn, socks4Rejected, nil, 0)
+		return fmt.Errorf("connect to %s failed: %s", ip, err)
+	}
+	defer target.Close()
+
+	local := target.LocalAddr().(*net.TCPAddr)
+	if err := socks4Reply(conn, socks4Granted, local.IP, local.Port); err != nil {
+		return fmt.Errorf("failed to send reply: %s", err)
+	}
+
+	s.relay(conn, r, target)
+	return nil
+}
+
+func socks4Reply(w io.Writer, status uint8, ip net.IP, port int) error {
+	msg := make([]byte, 8)
+	msg[1] = status
+	binary.BigEndian.PutUint16(msg[2:4], uint16(port))
+	if ip4 := ip.To4(); ip4 != nil {
+		copy(msg[4:], ip4)
+	}
+	_, err := w.Write(msg)
+	return err
+}
+
+// readNullString reads a null-terminated string of at most 255 bytes.
+func readNullString(r *bufio.Reader) (string, error) {
+	var buf []byte
+	for len(buf) < 256 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b == 0 {
+			return string(buf), nil
+		}
+		buf = append(buf, b)
+	}
+	return "", fmt.Errorf("string too long")
+}
@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// Unix socket clients have no IP address, but the SOCKS server and the rules
+// expect one, and look connections up by their address.  So they are treated
+// as loopback clients, each given an address of its own on 127.0.0.0/8 with
+// port 0, which no TCP client can have, so that they can't be confused with
+// TCP clients on loopback.
+const unixAddrs = 1<<24 - 2
+
+var lastUnixAddr uint32
+
+// unixSource is what the per-source connection limit counts all Unix socket
+// clients as.
+const unixSource = "unix"
+
+// unixConn is a Unix socket connection that reports a loopback TCP address
+// as its remote address.
+type unixConn struct {
+	net.Conn
+	remote *net.TCPAddr
+}
+
+func newUnixConn(conn net.Conn) *unixConn {
+	// 127.0.0.1 to 127.255.255.254, so a connection would have to outlive
+	// some 16 million others to share its address
+	n := atomic.AddUint32(&lastUnixAddr, 1)%unixAddrs + 1
+	return &unixConn{
+		Conn:   conn,
+		remote: &net.TCPAddr{IP: net.IPv4(127, byte(n>>16), byte(n>>8), byte(n))},
+	}
+}
+
+func (c *unixConn) RemoteAddr() net.Addr {
+	return c.remote
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+// tcpClientConn is a connection that reports a TCP client's address.
+type tcpClientConn struct {
+	net.Conn
+	remote *net.TCPAddr
+}
+
+func (c *tcpClientConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func TestUnixConnAddrs(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 5000; i++ {
+		client, _ := net.Pipe()
+		addr := newUnixConn(client).RemoteAddr().(*net.TCPAddr)
+		if !addr.IP.IsLoopback() {
+			t.Fatalf("%s isn't a loopback address", addr)
+		}
+		if addr.Port != 0 {
+			t.Fatalf("%s could be a TCP client's address", addr)
+		}
+		if seen[addr.String()] {
+			t.Fatalf("%s given out twice", addr)
+		}
+		seen[addr.String()] = true
+	}
+}
+
+func TestUnixConnLookup(t *testing.T) {
+	unixClient, _ := net.Pipe()
+	uc := newUnixConn(unixClient)
+	unix := newProxyConn(context.Background(), uc, 0)
+	unix.register()
+	defer unix.unregister()
+
+	// A TCP client from the same address, as far as a port allows
+	tcpClient, _ := net.Pipe()
+	tcp := newProxyConn(context.Background(), &tcpClientConn{
+		Conn:   tcpClient,
+		remote: &net.TCPAddr{IP: uc.remote.IP, Port: 61001},
+	}, 0)
+	tcp.register()
+	defer tcp.unregister()
+
+	if c := lookupConn(uc.remote.IP, uc.remote.Port); c != unix {
+		t.Errorf("lookup of the Unix client found %v", c)
+	}
+	if c := lookupConn(uc.remote.IP, 61001); c != tcp {
+		t.Errorf("lookup of the TCP client found %v", c)
+	}
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/proxy"
+)
+
+// UpstreamProxy is a SOCKS5 proxy that outbound connections are chained
+// through.
+type UpstreamProxy struct {
+	Addr     string
+	Username string
+	Password string
+
+	// Weight is the proxy's share of connections when balancing across
+	// several upstream proxies.
+	Weight int
+}
+
+// ParseUpstreamProxy parses a URL of the form
+// socks5://[user:pass@]host:port[?weight=n].  The weight defaults to 1.
+func ParseUpstreamProxy(rawurl string) (*UpstreamProxy, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, RedactURLError(err)
+	}
+	if u.Scheme != "socks5" {
+		return nil, fmt.Errorf("url is not a socks5 url: %s", RedactURL(rawurl))
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return nil, err
+	}
+
+	p := &UpstreamProxy{Addr: u.Host, Weight: 1}
+	for key, values := range u.Query() {
+		if key != "weight" {
+			return nil, fmt.Errorf("unknown parameter %q in %s", key, RedactURL(rawurl))
+		}
+		weight, err := strconv.Atoi(values[len(values)-1])
+		if err != nil || weight < 1 {
+			return nil, fmt.Errorf("weight must be a positive integer in %s", RedactURL(rawurl))
+		}
+		p.Weight = weight
+	}
+	if u.User != nil {
+		p.Username = u.User.Username()
+		p.Password, _ = u.User.Password()
+	}
+	return p, nil
+}
+
+// String returns the proxy's address, without the credentials.
+func (p *UpstreamProxy) String() string {
+	return "socks5://" + p.Addr
+}
+
+// DialContext connects to addr through the upstream proxy, using d to reach
+// the proxy itself.
+func (p *UpstreamProxy) DialContext(ctx context.Context, d *net.Dialer, network, addr string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("upstream proxy does not support network %s", network)
+	}
+
+	var auth *proxy.Auth
+	if p.Username != "" {
+		auth = &proxy.Auth{User: p.Username, Password: p.Password}
+	}
+	forward := &upstreamDialer{Dialer: d}
+	dialer, err := proxy.SOCKS5("tcp", p.Addr, auth, forward)
+	if err != nil {
+		return nil, err
+	}
+
+	// Host names are passed through, so that the upstream proxy resolves
+	// them
+	if _, err := dialer.(proxy.ContextDialer).DialContext(ctx, "tcp", addr); err != nil {
+		if forward.conn != nil && isUpstreamReply(err) {
+			return nil, &upstreamReplyError{proxy: p.Addr, addr: addr, err: err}
+		}
+		return nil, fmt.Errorf("upstream proxy %s: %s", p.Addr, err)
+	}
+
+	// Relay over the TCP connection itself, rather than the SOCKS
+	// connection wrapping it, so that TCP options can still be set on it
+	return forward.conn, nil
+}
+
+// upstreamDialer reaches the upstream proxy, and records the connection to
+// it.
+type upstreamDialer struct {
+	*net.Dialer
+	conn net.Conn
+}
+
+func (d *upstreamDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.Dialer.DialContext(ctx, network, addr)
+	if err == nil {
+		d.conn = conn
+	}
+	return conn, err
+}
+
+// isUpstreamReply returns whether err is the upstream proxy's reply that it
+// couldn't connect to the destination.  The SOCKS client only reports the
+// reply code in the error message.
+func isUpstreamReply(err error) bool {
+	if oe, ok := err.(*net.OpError); ok {
+		err = oe.Err
+	}
+	return strings.HasPrefix(err.Error(), "unknown error ")
+}
+
+// upstreamReplyError is returned when the upstream proxy was reached, but
+// couldn't connect to the destination.
+type upstreamReplyError struct {
+	proxy, addr string
+	err         error
+}
+
+func (e *upstreamReplyError) Error() string {
+	return fmt.Sprintf("upstream proxy %s: connect to %s failed: %s", e.proxy, e.addr, e.err)
+}
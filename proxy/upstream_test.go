@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+
+	socks5 "github.com/armon/go-socks5"
+)
+
+// startUpstream runs a SOCKS5 server requiring the given credentials, and
+// returns its address.
+func startUpstream(t *testing.T, user, password string) string {
+	t.Helper()
+	server, err := socks5.New(&socks5.Config{
+		Credentials: socks5.StaticCredentials{user: password},
+		Logger:      log.New(ioutil.Discard, "", 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go server.Serve(l)
+	return l.Addr().String()
+}
+
+func TestUpstreamProxy(t *testing.T) {
+	upstream := &UpstreamProxy{Addr: startUpstream(t, "user", "pass"), Username: "user", Password: "pass"}
+
+	dest, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dest.Close()
+	go func() {
+		conn, err := dest.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	conn, err := upstream.DialContext(context.Background(), &net.Dialer{}, "tcp", dest.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, ok := conn.(*net.TCPConn); !ok {
+		t.Errorf("got a %T, want the TCP connection to the proxy", conn)
+	}
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("got %q back, want %q", buf, "ping")
+	}
+}
+
+func TestUpstreamProxyErrors(t *testing.T) {
+	addr := startUpstream(t, "user", "pass")
+
+	// A destination nothing listens on
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := closed.Addr().String()
+	closed.Close()
+
+	tests := []struct {
+		name  string
+		proxy *UpstreamProxy
+		reply bool
+	}{
+		{name: "destination refused", proxy: &UpstreamProxy{Addr: addr, Username: "user", Password: "pass"}, reply: true},
+		{name: "wrong password", proxy: &UpstreamProxy{Addr: addr, Username: "user", Password: "wrong"}},
+		{name: "no credentials", proxy: &UpstreamProxy{Addr: addr}},
+		{name: "proxy unreachable", proxy: &UpstreamProxy{Addr: dest}},
+	}
+
+	for _, tt := range tests {
+		conn, err := tt.proxy.DialContext(context.Background(), &net.Dialer{}, "tcp", dest)
+		if err == nil {
+			conn.Close()
+			t.Errorf("%s: connected", tt.name)
+			continue
+		}
+		if _, reply := err.(*upstreamReplyError); reply != tt.reply {
+			t.Errorf("%s: got error %q, reply from the proxy %v, want %v", tt.name, err, reply, tt.reply)
+		}
+	}
+}
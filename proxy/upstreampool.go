@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upstreamDownTime is how long an upstream proxy that couldn't be reached is
+// skipped for, unless no other upstream proxy is available.
+const upstreamDownTime = 30 * time.Second
+
+// UpstreamPool balances outbound connections across one or more upstream
+// proxies by weighted round-robin.  If an upstream proxy can't be reached,
+// the connection fails over to the next one, and the failed proxy is
+// skipped for a while.
+type UpstreamPool struct {
+	mu        sync.Mutex
+	upstreams []*upstreamState
+}
+
+type upstreamState struct {
+	*UpstreamProxy
+
+	// current is the proxy's running weight for smooth weighted
+	// round-robin
+	current int
+
+	// downUntil is when to try the proxy again after it couldn't be
+	// reached
+	downUntil time.Time
+}
+
+// NewUpstreamPool returns a pool of the given upstream proxies.
+func NewUpstreamPool(upstreams ...*UpstreamProxy) *UpstreamPool {
+	p := &UpstreamPool{}
+	for _, u := range upstreams {
+		p.upstreams = append(p.upstreams, &upstreamState{UpstreamProxy: u})
+	}
+	return p
+}
+
+// String returns the addresses of the upstream proxies.
+func (p *UpstreamPool) String() string {
+	addrs := make([]string, len(p.upstreams))
+	for i, u := range p.upstreams {
+		addrs[i] = u.String()
+	}
+	return strings.Join(addrs, ", ")
+}
+
+// DialContext connects to addr through the next upstream proxy, failing over
+// to the others in turn if it can't be reached, and returns the proxy that
+// made the connection.
+func (p *UpstreamPool) DialContext(ctx context.Context, d *net.Dialer, network, addr string) (net.Conn, *UpstreamProxy, error) {
+	order := p.order()
+
+	var err error
+	for i, u := range order {
+		var conn net.Conn
+		conn, err = u.DialContext(ctx, d, network, addr)
+		if err == nil {
+			p.up(u)
+			return conn, u.UpstreamProxy, nil
+		}
+
+		// The proxy is fine if it reached the destination, and the other
+		// proxies won't do better if the connection timed out
+		if _, ok := err.(*upstreamReplyError); ok || ctx.Err() != nil {
+			return nil, nil, err
+		}
+		p.down(u, err)
+		if i+1 < len(order) {
+			log.Printf("debug: failing over to next upstream proxy dst=%q failed=%q error=%q", addr, u, err)
+		}
+	}
+	return nil, nil, err
+}
+
+// order returns the upstream proxies in the order to try them: the next one
+// chosen by smooth weighted round-robin among those that are up, then the
+// rest that are up, then those that are down.
+func (p *UpstreamPool) order() []*upstreamState {
+	now := time.Now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var up, down []*upstreamState
+	for _, u := range p.upstreams {
+		if now.Before(u.downUntil) {
+			down = append(down, u)
+		} else {
+			up = append(up, u)
+		}
+	}
+	if len(up) == 0 {
+		return down
+	}
+
+	var best, total int
+	for i, u := range up {
+		u.current += u.Weight
+		total += u.Weight
+		if u.current > up[best].current {
+			best = i
+		}
+	}
+	up[best].current -= total
+
+	order := make([]*upstreamState, 0, len(p.upstreams))
+	order = append(order, up[best:]...)
+	order = append(order, up[:best]...)
+	return append(order, down...)
+}
+
+// down marks the proxy as unreachable for upstreamDownTime.
+func (p *UpstreamPool) down(u *upstreamState, err error) {
+	p.mu.Lock()
+	wasUp := !time.Now().Before(u.downUntil)
+	u.downUntil = time.Now().Add(upstreamDownTime)
+	p.mu.Unlock()
+
+	if wasUp {
+		log.Printf("warning: upstream proxy is down, skipping it for %s upstream=%q error=%q", upstreamDownTime, u, err)
+	}
+}
+
+// up marks the proxy as reachable again.
+func (p *UpstreamPool) up(u *upstreamState) {
+	p.mu.Lock()
+	wasDown := !u.downUntil.IsZero()
+	u.downUntil = time.Time{}
+	p.mu.Unlock()
+
+	if wasDown {
+		log.Printf("info: upstream proxy is back up upstream=%q", u)
+	}
+}
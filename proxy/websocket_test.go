@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUpgradeWebSocketOrigin(t *testing.T) {
+	tests := []struct {
+		origin string
+		want   int
+	}{
+		{"", http.StatusSwitchingProtocols},
+		{"http://proxy.example:9091", http.StatusSwitchingProtocols},
+		{"https://PROXY.example:9091", http.StatusSwitchingProtocols},
+		{"http://proxy.example", http.StatusForbidden},
+		{"http://evil.example", http.StatusForbidden},
+		{"null", http.StatusForbidden},
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if conn, _, err := upgradeWebSocket(w, r); err == nil {
+			conn.Close()
+		}
+	}))
+	defer srv.Close()
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		req.Host = "proxy.example:9091"
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("Origin %q: %s", tt.origin, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("Origin %q: got status %d, want %d", tt.origin, resp.StatusCode, tt.want)
+		}
+	}
+}
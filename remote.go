@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bmbernie/socks/proxy"
+	"golang.org/x/crypto/ssh"
+)
+
+// Bounds of the backoff between attempts to re-establish a lost SSH
+// connection
+const (
+	minSSHReconnectDelay = time.Second
+	maxSSHReconnectDelay = time.Minute
+)
+
+// RemoteListener opens listening ports on a remote host over an SSH
+// connection, and can re-establish them if the connection is lost.
+type RemoteListener struct {
+	Host   string
+	Config *ssh.ClientConfig
+	Addrs  []string
+
+	// Jump hosts to go through, in order, to reach Host.  They are
+	// authenticated and verified with Config, except for the user name.
+	Jumps []SSHHop
+
+	// Interval between keepalive requests on the SSH connection, or 0 to
+	// send none.  A connection that doesn't answer one before the next is
+	// due is considered lost.
+	Keepalive time.Duration
+
+	// Egress has destinations resolved and connected to from the remote
+	// host, see DialContext and DialNameserver.  Nameserver is the DNS
+	// server to query, as the remote host reaches it; if empty, the first
+	// one in the remote host's /etc/resolv.conf is used.
+	Egress     bool
+	Nameserver string
+
+	// mu guards client and nameserver, which are replaced on reconnecting
+	// while connections may be dialed through them
+	mu         sync.Mutex
+	client     *ssh.Client
+	nameserver string
+
+	hops      []*ssh.Client
+	listeners []net.Listener
+}
+
+// SSHHop is a jump host on the way to the remote listener's host.
+type SSHHop struct {
+	User string
+	Host string
+}
+
+func (h SSHHop) String() string {
+	if h.User == "" {
+		return h.Host
+	}
+	return h.User + "@" + h.Host
+}
+
+// ParseSSHHop parses a jump host of the form [user@]host[:port].
+func ParseSSHHop(value string) (SSHHop, error) {
+	var h SSHHop
+	if i := strings.LastIndex(value, "@"); i >= 0 {
+		h.User, value = value[:i], value[i+1:]
+	}
+	if value == "" {
+		return h, fmt.Errorf("invalid jump host: no host given")
+	}
+	if _, _, err := net.SplitHostPort(value); err != nil {
+		value = net.JoinHostPort(strings.Trim(value, "[]"), "22")
+	}
+	h.Host = value
+	return h, nil
+}
+
+// sshAddr returns the host:port to connect to for an ssh:// URL: the port
+// is the given one if not zero, or else the URL's, or else 22.
+func sshAddr(u *url.URL, port uint16) string {
+	p := u.Port()
+	if port != 0 {
+		p = strconv.Itoa(int(port))
+	} else if p == "" {
+		p = "22"
+	}
+	return net.JoinHostPort(u.Hostname(), p)
+}
+
+// remoteBindAddrs returns the addresses with their hosts replaced by bind,
+// keeping their ports.
+func remoteBindAddrs(addrs []string, bind string) ([]string, error) {
+	bind = strings.Trim(bind, "[]")
+	bound := make([]string, len(addrs))
+	for i, addr := range addrs {
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		bound[i] = net.JoinHostPort(bind, port)
+	}
+	return bound, nil
+}
+
+// Connect dials the SSH server, through any jump hosts, and opens the
+// listening ports on it.
+func (r *RemoteListener) Connect() error {
+	client, hops, err := r.dial()
+	if err != nil {
+		return err
+	}
+
+	var listeners []net.Listener
+	for _, addr := range r.Addrs {
+		l, err := client.Listen("tcp", addr)
+		if err != nil {
+			closeSSHClients(client, hops)
+			return fmt.Errorf("error listening on %s on remote host: %s", addr, err)
+		}
+		listeners = append(listeners, l)
+	}
+
+	nameserver := r.Nameserver
+	if r.Egress && nameserver == "" {
+		var err error
+		if nameserver, err = remoteNameserver(client); err != nil {
+			closeSSHClients(client, hops)
+			return fmt.Errorf("could not find the remote host's DNS server (use --resolver to give one): %s", err)
+		}
+	}
+	if r.Egress {
+		log.Printf("info: resolving names using DNS server %s from the remote host", nameserver)
+	}
+
+	r.mu.Lock()
+	r.client = client
+	r.nameserver = nameserver
+	r.mu.Unlock()
+	r.hops = hops
+	r.listeners = listeners
+	if r.Keepalive > 0 {
+		go r.keepalive(client)
+	}
+	return nil
+}
+
+// keepalive sends keepalive requests on the SSH connection until it is
+// closed, closing it if the server stops answering.
+func (r *RemoteListener) keepalive(client *ssh.Client) {
+	ticker := time.NewTicker(r.Keepalive)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		reply := make(chan error, 1)
+		go func() {
+			// Servers may well not know this request, but any reply at
+			// all shows that the connection is alive
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+
+		select {
+		case err := <-reply:
+			if err == nil {
+				continue
+			}
+			log.Printf("debug: SSH keepalive to %s failed: %s", r.Host, err)
+		case <-time.After(r.Keepalive):
+			log.Printf("warning: SSH keepalive to %s timed out after %s", r.Host, r.Keepalive)
+		}
+
+		// Closing the connection closes the listeners, which lets Serve
+		// deal with it like any other lost connection.
+		client.Close()
+		return
+	}
+}
+
+// Listeners returns the listeners opened by the last successful Connect.
+func (r *RemoteListener) Listeners() []net.Listener {
+	return r.listeners
+}
+
+// dial connects to each jump host in turn, and through them to the remote
+// host.  It returns the client for the remote host and the jump hosts'
+// clients, which have to be kept open as long as it is in use.
+func (r *RemoteListener) dial() (*ssh.Client, []*ssh.Client, error) {
+	var (
+		hops []*ssh.Client
+		prev *ssh.Client
+	)
+	for _, hop := range r.Jumps {
+		config := *r.Config
+		if hop.User != "" {
+			config.User = hop.User
+		}
+
+		client, err := dialSSH(prev, hop.Host, &config)
+		if err != nil {
+			closeSSHClients(nil, hops)
+			return nil, nil, fmt.Errorf("error dialing jump host %s: %s", hop, err)
+		}
+		log.Printf("debug: connected to jump host %s", hop)
+		hops = append(hops, client)
+		prev = client
+	}
+
+	client, err := dialSSH(prev, r.Host, r.Config)
+	if err != nil {
+		closeSSHClients(nil, hops)
+		return nil, nil, fmt.Errorf("error dialing remote host: %s", err)
+	}
+	return client, hops, nil
+}
+
+// dialSSH connects to an SSH server, either directly or, if via isn't nil,
+// through a connection forwarded by another server.
+func dialSSH(via *ssh.Client, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	if via == nil {
+		return ssh.Dial("tcp", addr, config)
+	}
+
+	conn, err := via.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// closeSSHClients closes the client and then the jump hosts it was reached
+// through, last hop first.
+func closeSSHClients(client *ssh.Client, hops []*ssh.Client) {
+	if client != nil {
+		client.Close()
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hops[i].Close()
+	}
+}
+
+// Close closes the SSH connection, and with it the listeners.
+func (r *RemoteListener) Close() error {
+	r.mu.Lock()
+	client := r.client
+	r.mu.Unlock()
+	if client == nil {
+		return nil
+	}
+	err := client.Close()
+	closeSSHClients(nil, r.hops)
+	return err
+}
+
+// DialContext connects to addr from the remote host, through the SSH
+// connection, giving up if ctx is done first.
+func (r *RemoteListener) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	r.mu.Lock()
+	client := r.client
+	r.mu.Unlock()
+	if client == nil {
+		return nil, errors.New("not connected to the remote host")
+	}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		conn, err := client.Dial(network, addr)
+		results <- result{conn, err}
+	}()
+
+	select {
+	case res := <-results:
+		if res.err != nil {
+			return nil, res.err
+		}
+		return newRemoteConn(res.conn, addr), nil
+	case <-ctx.Done():
+		// Don't leave the connection open if it is made after all
+		go func() {
+			if res := <-results; res.conn != nil {
+				res.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// DialNameserver connects to the DNS server from the remote host, for a
+// resolver to send its queries over TCP.  The connection is closed once ctx
+// is done, since SSH channels have no deadlines to time the queries out.
+func (r *RemoteListener) DialNameserver(ctx context.Context) (net.Conn, error) {
+	r.mu.Lock()
+	nameserver := r.nameserver
+	r.mu.Unlock()
+
+	conn, err := r.DialContext(ctx, "tcp", nameserver)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	return conn, nil
+}
+
+// remoteNameserver returns the address of the first DNS server listed in
+// the remote host's /etc/resolv.conf.
+func remoteNameserver(client *ssh.Client) (string, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+
+	out, err := session.Output("cat /etc/resolv.conf")
+	if err != nil {
+		return "", fmt.Errorf("could not read /etc/resolv.conf: %s", err)
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53"), nil
+		}
+	}
+	return "", errors.New("no nameserver in /etc/resolv.conf")
+}
+
+// remoteConn is a connection forwarded from the remote host, which reports
+// the address it was made to rather than the SSH channel's placeholder.
+type remoteConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func newRemoteConn(conn net.Conn, addr string) net.Conn {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return conn
+	}
+	ip := net.ParseIP(host)
+	p, err := strconv.Atoi(port)
+	if ip == nil || err != nil {
+		return conn
+	}
+	return remoteConn{Conn: conn, addr: &net.TCPAddr{IP: ip, Port: p}}
+}
+
+func (c remoteConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// Serve serves the SOCKS server on the remote listeners until the server is
+// shut down.  If the SSH connection is lost, it either returns an error or,
+// if reconnect is set, keeps trying to re-establish it.
+func (r *RemoteListener) Serve(srv *proxy.Server, reconnect bool) error {
+	for {
+		if err := r.serveListeners(srv); err == nil {
+			return nil
+		} else if !reconnect {
+			return fmt.Errorf("lost SSH connection to %s: %s", r.Host, err)
+		} else {
+			log.Printf("warning: lost SSH connection to %s: %s", r.Host, err)
+		}
+		r.Close()
+
+		delay := minSSHReconnectDelay
+		for {
+			log.Printf("info: reconnecting to %s in %s", r.Host, delay)
+			time.Sleep(delay)
+			if srv.Closing() {
+				return nil
+			}
+
+			err := r.Connect()
+			if err == nil {
+				break
+			}
+			log.Printf("warning: could not reconnect to %s: %s", r.Host, err)
+
+			if delay *= 2; delay > maxSSHReconnectDelay {
+				delay = maxSSHReconnectDelay
+			}
+		}
+		log.Printf("info: reconnected to %s", r.Host)
+	}
+}
+
+// serveListeners serves on the current listeners until they are all closed.
+// It returns nil if they were closed by the server shutting down.
+func (r *RemoteListener) serveListeners(srv *proxy.Server) error {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	for _, l := range r.listeners {
+		wg.Add(1)
+		go func(l net.Listener) {
+			defer wg.Done()
+			if err := srv.Serve(l); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+
+				// Losing one listener means the connection is gone, so
+				// don't leave the others behind
+				r.Close()
+			}
+		}(l)
+	}
+	wg.Wait()
+	return firstErr
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// reloadFuncs are the functions registered with onSIGHUP.
+var reloadFuncs struct {
+	sync.Mutex
+	fns []func() error
+}
+
+// onSIGHUP calls fn every time the process receives a SIGHUP, once
+// handleSIGHUP has been called, or reload is called.  Errors from fn are
+// logged.
+func onSIGHUP(fn func() error) {
+	reloadFuncs.Lock()
+	reloadFuncs.fns = append(reloadFuncs.fns, fn)
+	reloadFuncs.Unlock()
+}
+
+// handleSIGHUP reloads on every SIGHUP the process receives, rather than
+// letting it terminate the process.
+func handleSIGHUP() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+
+	go func() {
+		for range ch {
+			log.Printf("info: received SIGHUP, reloading")
+			reload()
+		}
+	}()
+}
+
+// reload calls every function registered with onSIGHUP, as if the process
+// had received a SIGHUP, and returns the first error.  With nothing
+// registered, it is a no-op, with a warning saying what could be reloaded.
+func reload() error {
+	reloadFuncs.Lock()
+	fns := append([]func() error(nil), reloadFuncs.fns...)
+	reloadFuncs.Unlock()
+
+	if len(fns) == 0 {
+		log.Printf("warning: nothing to reload: settings from flags or --config only change on restart, " +
+			"use --rules-file or --auth-file for rules or credentials that can be reloaded")
+		return nil
+	}
+
+	var first error
+	for _, fn := range fns {
+		if err := fn(); err != nil {
+			log.Printf("error: %s", err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// shutdownSignal returns a channel that receives SIGINT and SIGTERM.
+func shutdownSignal() <-chan os.Signal {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	return ch
+}
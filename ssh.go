@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func SSHAgent() ssh.AuthMethod {
+	if sshAgent, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK")); err == nil {
+		return ssh.PublicKeysCallback(agent.NewClient(sshAgent).Signers)
+	}
+	return nil
+}
+
+// SSHKey returns an auth method using the private key in the given file.
+// The passphrase is used to decrypt the key if it is encrypted.
+func SSHKey(path, passphrase string) (ssh.AuthMethod, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM-encoded key found", path)
+	}
+
+	if x509.IsEncryptedPEMBlock(block) {
+		if passphrase == "" {
+			return nil, fmt.Errorf("%s: key is passphrase-protected, but no passphrase was given", path)
+		}
+
+		der, err := x509.DecryptPEMBlock(block, []byte(passphrase))
+		if err != nil {
+			return nil, fmt.Errorf("%s: could not decrypt key: %s", path, err)
+		}
+		data = pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der})
+	}
+
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: could not parse key: %s", path, err)
+	}
+	return ssh.PublicKeys(signer), nil
+}
+
+// keyboardInteractive answers keyboard-interactive prompts.  A prompt is
+// answered by the longest question it starts with, ignoring case and
+// surrounding whitespace, so that e.g. "password" answers "Password for
+// alice: ".  Prompts no question matches get the fallback answer.
+type keyboardInteractive struct {
+	answers  map[string]string
+	fallback string
+}
+
+// parseSSHAnswers builds a keyboardInteractive from "question=answer"
+// strings.
+func parseSSHAnswers(values []string) (*keyboardInteractive, error) {
+	cr := &keyboardInteractive{answers: make(map[string]string)}
+	for _, v := range values {
+		i := strings.Index(v, "=")
+		if i <= 0 || strings.TrimSpace(v[:i]) == "" {
+			return nil, fmt.Errorf("answer must be of the form question=answer: %s", v)
+		}
+		cr.set(v[:i], v[i+1:])
+	}
+	return cr, nil
+}
+
+// set answers prompts starting with question, unless an answer to it is
+// already set.
+func (cr *keyboardInteractive) set(question, answer string) {
+	question = normalizePrompt(question)
+	if _, ok := cr.answers[question]; !ok {
+		cr.answers[question] = answer
+	}
+}
+
+// answer returns the answer to a prompt, and whether a question matched it.
+func (cr *keyboardInteractive) answer(prompt string) (string, bool) {
+	prompt = normalizePrompt(prompt)
+	var question, answer string
+	matched := false
+	for q, a := range cr.answers {
+		if strings.HasPrefix(prompt, q) && (!matched || len(q) > len(question)) {
+			question, answer, matched = q, a, true
+		}
+	}
+	return answer, matched
+}
+
+func (cr *keyboardInteractive) Challenge(user string, instruction string, questions []string, echos []bool) ([]string, error) {
+	var answers []string
+	for _, q := range questions {
+		answer, ok := cr.answer(q)
+		switch {
+		case ok:
+			log.Printf("debug: answering SSH prompt %q", q)
+		case cr.fallback != "":
+			log.Printf("info: no answer configured for SSH prompt %q, sending the default answer", q)
+			answer = cr.fallback
+		default:
+			log.Printf("warning: no answer configured for SSH prompt %q, sending an empty answer", q)
+		}
+		answers = append(answers, answer)
+	}
+	return answers, nil
+}
+
+// normalizePrompt puts a prompt or question in the form they are matched in.
+func normalizePrompt(s string) string {
+	return strings.ToLower(strings.TrimSpace(s))
+}
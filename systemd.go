@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/activation"
+	"github.com/coreos/go-systemd/v22/daemon"
+)
+
+// The first file descriptor passed by systemd socket activation
+const sdListenFDsStart = 3
+
+// activationListeners returns the listening sockets passed in by systemd
+// socket activation, or nil if the process wasn't socket-activated.  See
+// sd_listen_fds(3).
+func activationListeners() ([]net.Listener, error) {
+	listeners, err := activation.Listeners()
+	if err != nil || len(listeners) == 0 {
+		return nil, err
+	}
+	for i, l := range listeners {
+		if l == nil {
+			return nil, fmt.Errorf("file descriptor %d is not a listening socket", sdListenFDsStart+i)
+		}
+	}
+	return listeners, nil
+}
+
+// sdNotify sends a state change, such as "READY=1", to systemd.  It does
+// nothing if the process isn't running under systemd.  See sd_notify(3).
+func sdNotify(state string) error {
+	_, err := daemon.SdNotify(false, state)
+	return err
+}
+
+// sdWatchdog pings the systemd watchdog, if enabled, at half the required
+// interval so that a late ping doesn't get the process killed.
+func sdWatchdog() {
+	interval, err := daemon.SdWatchdogEnabled(false)
+	if err != nil {
+		log.Printf("warning: could not check for systemd watchdog: %s", err)
+		return
+	}
+	if interval == 0 {
+		return
+	}
+
+	log.Printf("debug: sending systemd watchdog pings every %s", interval/2)
+	go func() {
+		for range time.Tick(interval / 2) {
+			if err := sdNotify(daemon.SdNotifyWatchdog); err != nil {
+				log.Printf("warning: could not ping systemd watchdog: %s", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/bmbernie/socks/proxy"
+	flag "github.com/ogier/pflag"
+)
+
+// validateFlags checks the flags for values and combinations that make no
+// sense, so that misconfigurations are reported before anything starts.
+func validateFlags(fs *flag.FlagSet) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	if _, ok := logLevels[flagLogLevel]; !ok {
+		return fmt.Errorf("unknown log level %q, expected trace, debug, info, warning or error", flagLogLevel)
+	}
+	if set["log-level"] && (flagQuiet || flagVerbose || flagTrace) {
+		return errors.New("--log-level can't be combined with --quiet, --verbose or --trace")
+	}
+	if flagQuiet && (flagVerbose || flagTrace) {
+		return errors.New("--quiet can't be combined with --verbose or --trace")
+	}
+	if flagLogFormat != "text" && flagLogFormat != "json" {
+		return fmt.Errorf("unknown log format %q, expected text or json", flagLogFormat)
+	}
+	if flagLogSample < 0 {
+		return errors.New("--log-sample can't be negative")
+	}
+	if flagLogMaxBackups < 0 {
+		return errors.New("--log-max-backups can't be negative")
+	}
+
+	if len(flagListen) > 0 && (set["host"] || set["port"]) {
+		return errors.New("--listen can't be combined with --host or --port")
+	}
+	if _, ok := unixSocketPath(flagHost); ok && set["port"] {
+		return errors.New("--port can't be used with a Unix socket --host")
+	}
+	if _, err := parseSocketMode(flagSocketMode); err != nil {
+		return fmt.Errorf("invalid --socket-mode %q, expected an octal mode such as 0660", flagSocketMode)
+	}
+	if len(flagListen) == 0 && flagRemoteListener == "" && flagPort == 0 {
+		return errors.New("--port must be nonzero")
+	}
+
+	if flagPprofAddr != "" {
+		for _, addr := range []string{flagMetricsAddr, flagHealthAddr, flagEventsAddr} {
+			if addr == flagPprofAddr {
+				return errors.New("--pprof-addr must be separate from the metrics, health and events addresses")
+			}
+		}
+	}
+	if _, err := proxy.ParseDenyMode(flagDenyMode); err != nil {
+		return fmt.Errorf("invalid --deny-mode value: %s", err)
+	}
+	if flagTarpitDuration <= 0 {
+		return errors.New("--tarpit-duration must be positive")
+	}
+	if flagBanThreshold < 0 {
+		return errors.New("--ban-threshold can't be negative")
+	}
+	if flagBanDuration <= 0 {
+		return errors.New("--ban-duration must be positive")
+	}
+	if flagDialRetries < 0 {
+		return errors.New("--dial-retries can't be negative")
+	}
+	if flagMaxConnections < 0 || flagMaxConnectionsPerSource < 0 || flagMaxConcurrent < 0 {
+		return errors.New("connection limits can't be negative")
+	}
+	if flagShutdownTimeout < 0 || flagDialTimeout < 0 || flagQueueTimeout < 0 || flagHandshakeTimeout < 0 {
+		return errors.New("timeouts can't be negative")
+	}
+	if flagNoResolve {
+		for _, name := range []string{
+			"resolver", "dns-cache-ttl", "dns-cache-size", "allow-domain", "deny-domain",
+			"blocklist-url", "blocklist-refresh", "dial-parallel",
+		} {
+			if set[name] {
+				return fmt.Errorf("--%s has no effect with --no-resolve", name)
+			}
+		}
+	}
+	if flagSNIFilter && len(flagAllowDomains) == 0 && len(flagDenyDomains) == 0 && flagBlocklistURL == "" {
+		return errors.New("--sni-filter requires --allow-domain, --deny-domain or --blocklist-url")
+	}
+	if flagBlocklistRefresh < 0 {
+		return errors.New("--blocklist-refresh can't be negative")
+	}
+	if flagBlocklistRefresh > 0 && flagBlocklistURL == "" {
+		return errors.New("--blocklist-refresh requires --blocklist-url")
+	}
+	if flagDNSCacheTTL < 0 {
+		return errors.New("--dns-cache-ttl can't be negative")
+	}
+	if flagDNSCacheTTL > 0 && flagDNSCacheSize < 1 {
+		return errors.New("--dns-cache-size must be at least 1")
+	}
+	if flagMaxConnectionAge < 0 || flagMaxUptime < 0 || flagIdleTimeout < 0 {
+		return errors.New("--max-connection-age, --max-uptime and --idle-timeout can't be negative")
+	}
+	if flagAccountingInterval <= 0 {
+		return errors.New("--accounting-interval must be positive")
+	}
+
+	if _, err := proxy.MakeCredentials(flagAuth); err != nil {
+		return fmt.Errorf("invalid --auth value: %s", err)
+	}
+	if flagAuthFile != "" {
+		if _, err := proxy.ReadCredentialsFile(flagAuthFile); err != nil {
+			return fmt.Errorf("invalid --auth-file: %s", err)
+		}
+	}
+
+	if flagAuthPAM != "" {
+		if len(flagAuth) > 0 || flagAuthFile != "" {
+			return errors.New("--auth-pam can't be combined with --auth or --auth-file")
+		}
+		if _, err := proxy.NewPAMCredentials(flagAuthPAM); err != nil {
+			return fmt.Errorf("invalid --auth-pam: %s", err)
+		}
+	}
+	if flagAuthGSSAPI != "" {
+		if _, err := os.Stat(flagAuthGSSAPI); err != nil {
+			return fmt.Errorf("invalid --auth-gssapi: %s", err)
+		}
+	}
+	if flagAuthMethods != "" {
+		names, err := parseAuthMethods(flagAuthMethods)
+		if err != nil {
+			return fmt.Errorf("invalid --auth-methods value: %s", err)
+		}
+		for _, name := range names {
+			switch {
+			case name == "password" && len(flagAuth) == 0 && flagAuthFile == "" && flagAuthPAM == "":
+				return errors.New("--auth-methods password requires --auth, --auth-file or --auth-pam")
+			case name == "gssapi" && flagAuthGSSAPI == "":
+				return errors.New("--auth-methods gssapi requires --auth-gssapi")
+			}
+		}
+	}
+
+	if (len(flagAllowCountries) > 0 || len(flagDenyCountries) > 0) && flagGeoIPDB == "" {
+		return errors.New("--allow-country and --deny-country require --geoip-db")
+	}
+
+	if (flagTLSCert == "") != (flagTLSKey == "") {
+		return errors.New("--tls-cert and --tls-key must be given together")
+	}
+	if flagTLSCert == "" && (set["tls-min-version"] || set["tls-client-ca"]) {
+		return errors.New("--tls-min-version and --tls-client-ca require --tls-cert")
+	}
+	if _, err := proxy.ParseTLSVersion(flagTLSMinVersion); err != nil {
+		return fmt.Errorf("invalid --tls-min-version value: %s", err)
+	}
+
+	if flagRemoteListener == "" {
+		for _, name := range []string{
+			"ssh-key", "ssh-key-passphrase", "ssh-insecure", "ssh-otp", "ssh-answer", "ssh-default-answer",
+			"ssh-port", "ssh-jump", "ssh-reconnect", "ssh-keepalive", "remote-bind",
+			"remote-egress",
+		} {
+			if set[name] {
+				return fmt.Errorf("--%s requires --remote-listener", name)
+			}
+		}
+	}
+	if flagRemoteListener != "" {
+		for _, addr := range append([]string{flagHost}, flagListen...) {
+			if _, ok := unixSocketPath(addr); ok {
+				return errors.New("--remote-listener can't listen on a Unix socket")
+			}
+		}
+		// BIND would listen on this host, which the remote clients' peers
+		// have no reason to be able to reach
+		if flagAllowBind {
+			return errors.New("--allow-bind can't be used with --remote-listener")
+		}
+	}
+	if flagSSHKeyPassphrase != "" && flagSSHKey == "" {
+		return errors.New("--ssh-key-passphrase requires --ssh-key")
+	}
+	if flagSSHKey != "" {
+		if _, err := SSHKey(flagSSHKey, flagSSHKeyPassphrase); err != nil {
+			return fmt.Errorf("invalid --ssh-key: %s", err)
+		}
+	}
+	if flagSSHKeepalive < 0 {
+		return errors.New("--ssh-keepalive can't be negative")
+	}
+	if flagRemoteEgress && len(flagUpstreamProxies) > 0 {
+		return errors.New("--remote-egress can't be used with --upstream-proxy")
+	}
+	if flagRemoteEgress && flagBindAddr != "" {
+		return errors.New("--remote-egress can't be used with --bind-addr")
+	}
+
+	return nil
+}
@@ -0,0 +1,17 @@
+package main
+
+import "fmt"
+
+// Build information, set at build time with e.g.
+//
+//	go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%d)"
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+// versionString describes the build, for --version.
+func versionString() string {
+	return fmt.Sprintf("socks %s (commit %s, built %s)", version, commit, buildDate)
+}